@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Permissions maps GitHub App installation permission names (e.g. "contents", "checks") to an access level
+type Permissions map[string]AccessLevel
+
+// accessLevelRank orders access levels so they can be compared
+var accessLevelRank = map[AccessLevel]int{
+	AccessLevelRead:  1,
+	AccessLevelWrite: 2,
+	AccessLevelAdmin: 3,
+}
+
+// Valid returns true if the access level is one GitHub understands
+func (a AccessLevel) Valid() bool {
+	_, ok := accessLevelRank[a]
+	return ok
+}
+
+// Includes returns true if access level a grants at least as much as access level b
+func (a AccessLevel) Includes(b AccessLevel) bool {
+	return accessLevelRank[a] >= accessLevelRank[b]
+}
+
+// Validate ensures every permission has a valid access level
+func (p Permissions) Validate() error {
+	for name, level := range p {
+		if name == "" {
+			return fmt.Errorf("permission name must not be empty")
+		}
+		if !level.Valid() {
+			return fmt.Errorf("invalid access level '%s' for permission %s", level, name)
+		}
+	}
+	return nil
+}
+
+// Exceeding returns the sorted list of permissions (as name:level) which are not covered by the ceiling
+func (p Permissions) Exceeding(ceiling Permissions) []string {
+	exceeding := make([]string, 0)
+	for name, level := range p {
+		max, ok := ceiling[name]
+		if !ok || !max.Includes(level) {
+			exceeding = append(exceeding, fmt.Sprintf("%s:%s", name, level))
+		}
+	}
+	sort.Strings(exceeding)
+	return exceeding
+}
+
+// Copy returns a shallow copy of the permissions
+func (p Permissions) Copy() Permissions {
+	ret := make(Permissions, len(p))
+	for name, level := range p {
+		ret[name] = level
+	}
+	return ret
+}
+
+// minAccessLevel returns the lower of two access levels
+func minAccessLevel(a, b AccessLevel) AccessLevel {
+	if a.Includes(b) {
+		return b
+	}
+	return a
+}
+
+// Cap returns a copy of the permissions with every level lowered to at most max
+func (p Permissions) Cap(max AccessLevel) Permissions {
+	ret := make(Permissions, len(p))
+	for name, level := range p {
+		ret[name] = minAccessLevel(level, max)
+	}
+	return ret
+}
+
+// Intersect returns the permissions present in both p and limit, at the lower of the two levels
+func (p Permissions) Intersect(limit Permissions) Permissions {
+	ret := make(Permissions)
+	for name, level := range p {
+		if max, ok := limit[name]; ok {
+			ret[name] = minAccessLevel(level, max)
+		}
+	}
+	return ret
+}
+
+// Union returns the permissions present in either p or other, at the higher of the two levels
+func (p Permissions) Union(other Permissions) Permissions {
+	ret := p.Copy()
+	for name, level := range other {
+		if current, ok := ret[name]; !ok || !current.Includes(level) {
+			ret[name] = level
+		}
+	}
+	return ret
+}
+
+// Highest returns the highest access level in the permissions, or an empty AccessLevel if there are none
+func (p Permissions) Highest() AccessLevel {
+	var highest AccessLevel
+	for _, level := range p {
+		if highest == "" || !highest.Includes(level) {
+			highest = level
+		}
+	}
+	return highest
+}
+
+// BeyondMetadata returns true if the permissions grant more than metadata access, which every token has
+func (p Permissions) BeyondMetadata() bool {
+	for name := range p {
+		if name != "metadata" {
+			return true
+		}
+	}
+	return false
+}
+
+// Restrict returns the permissions limited to the given set. Metadata read access is always
+// kept since GitHub requires it for any token.
+func (p Permissions) Restrict(limit Permissions) Permissions {
+	limit = limit.Copy()
+	if _, ok := limit["metadata"]; !ok {
+		limit["metadata"] = AccessLevelRead
+	}
+	return p.Intersect(limit)
+}
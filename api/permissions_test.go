@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionsExceeding(t *testing.T) {
+	ceiling := Permissions{
+		"metadata": AccessLevelRead,
+		"contents": AccessLevelWrite,
+	}
+
+	t.Run("withinCeiling", func(t *testing.T) {
+		assert.Empty(t, Permissions{"metadata": AccessLevelRead, "contents": AccessLevelRead}.Exceeding(ceiling))
+	})
+	t.Run("levelTooHigh", func(t *testing.T) {
+		assert.Equal(t, []string{"contents:admin", "metadata:write"}, Permissions{"metadata": AccessLevelWrite, "contents": AccessLevelAdmin}.Exceeding(ceiling))
+	})
+	t.Run("notInCeiling", func(t *testing.T) {
+		assert.Equal(t, []string{"checks:read"}, Permissions{"checks": AccessLevelRead}.Exceeding(ceiling))
+	})
+}
+
+func TestPermissionsBeyondMetadata(t *testing.T) {
+	assert.True(t, Permissions{"metadata": AccessLevelRead, "contents": AccessLevelRead}.BeyondMetadata())
+	assert.False(t, Permissions{"metadata": AccessLevelRead}.BeyondMetadata())
+	assert.False(t, Permissions{}.BeyondMetadata())
+}
+
+func TestTokenRequestPermissions(t *testing.T) {
+	t.Run("legacyAccessLevel", func(t *testing.T) {
+		tr := TokenRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{"repositories": ["myorg/myrepo"], "access_level": "write"}`), &tr))
+		assert.Equal(t, Permissions{
+			"metadata":      AccessLevelRead,
+			"contents":      AccessLevelWrite,
+			"pull_requests": AccessLevelWrite,
+		}, tr.RequestedPermissions())
+	})
+	t.Run("explicitPermissions", func(t *testing.T) {
+		tr := TokenRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{"repositories": ["myorg/myrepo"], "permissions": {"checks": "write"}}`), &tr))
+		assert.Equal(t, Permissions{
+			"metadata": AccessLevelRead,
+			"checks":   AccessLevelWrite,
+		}, tr.RequestedPermissions())
+	})
+	t.Run("invalidLevel", func(t *testing.T) {
+		tr := TokenRequest{}
+		require.Error(t, json.Unmarshal([]byte(`{"repositories": ["myorg/myrepo"], "permissions": {"checks": "all"}}`), &tr))
+	})
+}
@@ -12,6 +12,14 @@ import (
 type TokenRequest struct {
 	Repositories []repoparser.RepositoryName `json:"repositories"`
 	AccessLevel  AccessLevel                 `json:"access_level" default:"read"`
+
+	// Permissions optionally requests an explicit set of GitHub installation permissions.
+	// When set, AccessLevel is ignored.
+	Permissions Permissions `json:"permissions,omitempty"`
+
+	// AllowDowngrade issues a token with reduced permissions instead of refusing the request
+	// when a repository grants less than what was requested
+	AllowDowngrade bool `json:"allow_downgrade,omitempty"`
 }
 
 type AccessLevel string
@@ -19,11 +27,14 @@ type AccessLevel string
 const (
 	AccessLevelRead  AccessLevel = "read"
 	AccessLevelWrite AccessLevel = "write"
+	AccessLevelAdmin AccessLevel = "admin"
 )
 
 type rawTokenRequest struct {
 	Repositories []string    `json:"repositories"`
 	AccessLevel  AccessLevel `json:"access_level" default:"read"`
+	Permissions  Permissions `json:"permissions"`
+	Downgrade    bool        `json:"allow_downgrade"`
 }
 
 // UnmarshalJSON is a custom unmarshaller that ensures all "repositories" point to a valid repository name
@@ -37,8 +48,17 @@ func (tr *TokenRequest) UnmarshalJSON(data []byte) error {
 	if raw.AccessLevel == "" {
 		raw.AccessLevel = "read"
 	}
+	if !raw.AccessLevel.Valid() {
+		return fmt.Errorf("invalid access_level %s", raw.AccessLevel)
+	}
 	tr.AccessLevel = raw.AccessLevel
 
+	if err := raw.Permissions.Validate(); err != nil {
+		return err
+	}
+	tr.Permissions = raw.Permissions
+	tr.AllowDowngrade = raw.Downgrade
+
 	tr.Repositories = make([]repoparser.RepositoryName, len(raw.Repositories))
 	for idx, repoString := range raw.Repositories {
 		repo, err := repoparser.ExtractOrgRepoFromURL(repoString)
@@ -50,9 +70,121 @@ func (tr *TokenRequest) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// RequestedPermissions returns the GitHub installation permissions this request asks for.
+// Without explicit permissions, contents and pull_requests are requested at AccessLevel.
+// Metadata read access is always included since GitHub requires it.
+func (tr *TokenRequest) RequestedPermissions() Permissions {
+	if len(tr.Permissions) == 0 {
+		return Permissions{
+			"metadata":      AccessLevelRead,
+			"contents":      tr.AccessLevel,
+			"pull_requests": tr.AccessLevel,
+		}
+	}
+
+	perms := tr.Permissions.Copy()
+	if _, ok := perms["metadata"]; !ok {
+		perms["metadata"] = AccessLevelRead
+	}
+	return perms
+}
+
 // TokenResponse represents the HTTP response to the /token request
 type TokenResponse struct {
-	Token     string    `json:"token"`
+	// Token and ExpiresAt are only set if a single token covers all requested repositories
+	Token     string    `json:"token,omitempty"`
 	ExpiresAt time.Time `json:"expires_at"`
-	RequestID string    `json:"req_id"`
+
+	// Tokens holds one token per GitHub host and organization of the requested repositories
+	Tokens []ScopedToken `json:"tokens"`
+
+	RequestID   string               `json:"req_id"`
+	Permissions Permissions          `json:"permissions,omitempty"`
+	Decisions   []RepositoryDecision `json:"decisions,omitempty"`
+}
+
+// ScopedToken is a GitHub installation token limited to a set of repositories in a single organization
+type ScopedToken struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Host         string    `json:"host"`
+	Organization string    `json:"organization"`
+	Repositories []string  `json:"repositories"`
+}
+
+// TokenFor returns the token covering a given repository, or nil if there is none
+func (tr *TokenResponse) TokenFor(repo repoparser.RepositoryName) *ScopedToken {
+	for idx, token := range tr.Tokens {
+		for _, r := range token.Repositories {
+			if r == repo.HTTPS() {
+				return &tr.Tokens[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// RepositoryDecision explains why access to a single repository was granted or refused
+type RepositoryDecision struct {
+	Repository string      `json:"repository"`
+	Allowed    bool        `json:"allowed"`
+	Access     AccessLevel `json:"access,omitempty"`
+	Rule       string      `json:"rule"`
+	Reason     string      `json:"reason"`
+
+	// Permissions is what the repository grants out of the requested permissions, if it restricts them
+	Permissions Permissions `json:"permissions,omitempty"`
+}
+
+// RevokeResponse represents the HTTP response to the DELETE /token request
+type RevokeResponse struct {
+	// Revoked is the number of tokens of the calling job which were revoked
+	Revoked int `json:"revoked"`
+
+	// Unknown is set if the server has no record of tokens issued to the job, as opposed to having revoked them
+	// already. The server only remembers the tokens it minted itself since it started, tokens minted by another
+	// replica or before a restart are not revoked.
+	Unknown bool `json:"unknown,omitempty"`
+
+	RequestID string `json:"req_id"`
+}
+
+// ExplainResponse represents the HTTP response to the /token/explain request. It describes what /token would
+// decide for the same request without issuing a token.
+type ExplainResponse struct {
+	// Allowed is true if /token would issue a token
+	Allowed bool `json:"allowed"`
+
+	// Reason explains why /token would refuse the request
+	Reason string `json:"reason,omitempty"`
+
+	// Permissions are the permissions a token would be issued with
+	Permissions Permissions `json:"permissions,omitempty"`
+
+	Repositories []RepositoryExplanation `json:"repositories"`
+	RequestID    string                  `json:"req_id"`
+}
+
+// RepositoryExplanation is the decision for a single repository and the checks which led to it
+type RepositoryExplanation struct {
+	RepositoryDecision
+	Trace []TraceStep `json:"trace"`
+}
+
+// TraceStep is a single check made while deciding on access to a repository
+type TraceStep struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	Detail  string `json:"detail"`
+
+	// GitOpsEntries are the gitops.yaml repos entries compared against the pipeline's repository
+	GitOpsEntries []GitOpsEntryTrace `json:"gitops_entries,omitempty"`
+}
+
+// GitOpsEntryTrace is the result of comparing a gitops.yaml repos entry with the pipeline's repository
+type GitOpsEntryTrace struct {
+	Repository        string      `json:"repository"`
+	Access            AccessLevel `json:"access"`
+	RepositoryMatches bool        `json:"repository_matches"`
+	ConditionsMatch   bool        `json:"conditions_match"`
 }
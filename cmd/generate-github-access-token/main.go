@@ -19,7 +19,16 @@ func main() {
 
 	repoFlag := flag.String("repositories", "", "repositories to request access to (can be multiple, comma separated)")
 	accessFlag := flag.String("access", "read", "access level ('read' or 'write')")
+	permissionsFlag := flag.String("permissions", "", "explicit github permissions, overrides -access (comma separated, e.g. 'contents:write,checks:write')")
+	downgradeFlag := flag.Bool("allow-downgrade", false, "accept a token with fewer permissions if a repository grants less than requested")
+	explainFlag := flag.Bool("explain", false, "explain the server's decision per repository instead of issuing a token")
 	flag.Parse()
+	if flag.Arg(0) == "revoke" {
+		if err := client.NewClient("http://localhost:8080").RevokeJobTokens(log.Default()); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
 	if *repoFlag == "" {
 		log.Print("no repositories specified")
 		os.Exit(0)
@@ -27,27 +36,35 @@ func main() {
 
 	repositories := make([]repoparser.RepositoryName, 0)
 	// Process and validate input repos
-	var lastHostOrg string
 	for _, repo := range strings.Split(*repoFlag, ",") {
 		parsedRepo, err := repoparser.ExtractOrgRepoFromURL(repo)
 		if err != nil {
 			log.Fatalf("unable to parse repository '%s': %s", repo, err.Error())
 		}
-		currentHostOrg := fmt.Sprintf("%s/%s", parsedRepo.Host, parsedRepo.Org)
-
-		if lastHostOrg != "" && currentHostOrg != lastHostOrg {
-			log.Fatalf("unable to generate access tokens spanning multiple organizations. Got %s, but already seen %s", currentHostOrg, lastHostOrg)
-		}
 		repositories = append(repositories, parsedRepo)
-		lastHostOrg = currentHostOrg
 	}
 
 	req := &api.TokenRequest{
-		Repositories: repositories,
-		AccessLevel:  api.AccessLevel(*accessFlag),
+		Repositories:   repositories,
+		AccessLevel:    api.AccessLevel(*accessFlag),
+		AllowDowngrade: *downgradeFlag,
+	}
+	if *permissionsFlag != "" {
+		req.Permissions = api.Permissions{}
+		for _, perm := range strings.Split(*permissionsFlag, ",") {
+			permSplit := strings.SplitN(perm, ":", 2)
+			if len(permSplit) != 2 {
+				log.Fatalf("unable to parse permission '%s', expected name:level", perm)
+			}
+			req.Permissions[permSplit[0]] = api.AccessLevel(permSplit[1])
+		}
 	}
 
 	client := client.NewClient("http://localhost:8080")
+	if *explainFlag {
+		explainToken(client, req)
+		return
+	}
 	resp, errorResp, err := client.GetToken(req)
 	if err != nil {
 		log.Printf("server returned error")
@@ -61,7 +78,58 @@ func main() {
 	}
 
 	log.Printf("server request ID: %s", resp.RequestID)
-	log.Printf("token expires at: %s", resp.ExpiresAt)
 
-	fmt.Printf("%s\n", resp.Token)
+	if len(resp.Tokens) == 1 {
+		log.Printf("token expires at: %s", resp.Tokens[0].ExpiresAt)
+		fmt.Printf("%s\n", resp.Tokens[0].Token)
+		return
+	}
+
+	// Repositories span several organizations, print one "host/org token" line per token
+	for _, token := range resp.Tokens {
+		log.Printf("token for %s/%s expires at: %s", token.Host, token.Organization, token.ExpiresAt)
+		fmt.Printf("%s/%s %s\n", token.Host, token.Organization, token.Token)
+	}
+}
+
+// explainToken prints why the server would issue or refuse a token for the request
+func explainToken(c *client.Client, req *api.TokenRequest) {
+	resp, errorResp, err := c.ExplainToken(req)
+	if err != nil {
+		log.Printf("server returned error")
+		if errorResp != nil {
+			log.Printf("server request ID: %s", errorResp.RequestID)
+			log.Printf("server message: %s", errorResp.Message)
+		} else {
+			log.Printf("%s", err)
+		}
+		os.Exit(1)
+	}
+
+	log.Printf("server request ID: %s", resp.RequestID)
+	for _, repo := range resp.Repositories {
+		fmt.Printf("%s: allowed=%t rule=%s\n", repo.Repository, repo.Allowed, repo.Rule)
+		if repo.Reason != "" {
+			fmt.Printf("  reason: %s\n", repo.Reason)
+		}
+		for _, step := range repo.Trace {
+			fmt.Printf("  [%s] %s: %s\n", matchedMark(step.Matched), step.Rule, step.Detail)
+			for _, entry := range step.GitOpsEntries {
+				fmt.Printf("      %s (access %s): repository matches=%t, conditions match=%t\n",
+					entry.Repository, entry.Access, entry.RepositoryMatches, entry.ConditionsMatch)
+			}
+		}
+	}
+	if !resp.Allowed {
+		fmt.Printf("token would be refused: %s\n", resp.Reason)
+		os.Exit(1)
+	}
+	fmt.Printf("token would be issued with permissions: %v\n", resp.Permissions)
+}
+
+func matchedMark(matched bool) string {
+	if matched {
+		return "x"
+	}
+	return " "
 }
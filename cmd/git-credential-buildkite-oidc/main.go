@@ -17,6 +17,14 @@ var Version = "dev"
 func main() {
 	log.Printf("git-credential-github-app %s starting up", Version)
 
+	// 'revoke' is not a git-credential action, it is run from a pre-exit hook to revoke the job's tokens
+	if len(os.Args) == 2 && os.Args[1] == "revoke" {
+		if err := client.NewClient("http://localhost:8080").RevokeJobTokens(log.Default()); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
+
 	// We only do something if the action was 'get', this credential helper does not act
 	// as a store
 	// https://git-scm.com/docs/gitcredentials#_custom_helpers
@@ -24,11 +32,15 @@ func main() {
 	// > ignore the request.
 	// > If a helper receives any other operation, it should silently ignore the request. This leaves room for future
 	// > operations to be added (older helpers will just ignore the new requests).
-	switch gitcredentials.GetCredentialAction() {
+	action, err := gitcredentials.GetCredentialAction(os.Args)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	switch action {
 	case "get":
 		issueGitHubToken()
 	default:
-		log.Printf("ignoring action %s", gitcredentials.GetCredentialAction())
+		log.Printf("ignoring action %s", action)
 		os.Exit(0)
 	}
 }
@@ -64,6 +76,8 @@ func issueGitHubToken() {
 	resp, errorResp, err := client.GetToken(&api.TokenRequest{
 		Repositories: []repoparser.RepositoryName{repo},
 		AccessLevel:  api.AccessLevelWrite,
+		// git does not tell whether it is going to fetch or push, read access is enough to fetch e.g. plugins
+		AllowDowngrade: true,
 	})
 	if err != nil {
 		log.Printf("server returned error")
@@ -77,11 +91,16 @@ func issueGitHubToken() {
 	}
 
 	log.Printf("server request ID: %s", resp.RequestID)
-	log.Printf("token expires at: %s", resp.ExpiresAt)
+
+	token := resp.TokenFor(repo)
+	if token == nil {
+		log.Fatalf("server did not return a token for %s", repo.HTTPS())
+	}
+	log.Printf("token expires at: %s", token.ExpiresAt)
 
 	gitcredentials.SendOutput(gitcredentials.GitCredentialResponse{
 		Username: "x-access-token",
-		Password: resp.Token,
+		Password: token.Token,
 		Quit:     true,
 	}, os.Stdout)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/github"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+var Version = "dev"
+
+func main() {
+	pipelineRepoFlag := flag.String("pipeline-repo", "", "optionally check whether a pipeline building this repository would be granted access")
+	accessFlag := flag.String("access", "write", "access level to check -pipeline-repo for ('read' or 'write')")
+	organizationFlag := flag.String("organization", "", "buildkite organization slug of the build to check")
+	pipelineFlag := flag.String("pipeline", "", "buildkite pipeline slug of the build to check")
+	branchFlag := flag.String("branch", "", "branch of the build to check")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "gitops-lint %s\n\nUsage: %s [flags] [gitops.yaml|gitops.json ...]\n", Version, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"gitops.yaml"}
+	}
+
+	var pipelineRepo *repoparser.RepositoryName
+	if *pipelineRepoFlag != "" {
+		repo, err := repoparser.ExtractOrgRepoFromURL(*pipelineRepoFlag)
+		if err != nil {
+			log.Fatalf("unable to parse pipeline repository '%s': %s", *pipelineRepoFlag, err.Error())
+		}
+		pipelineRepo = &repo
+	}
+	claims := buildkite.Claims{
+		OrganizationSlug: *organizationFlag,
+		PipelineSlug:     *pipelineFlag,
+		BuildBranch:      *branchFlag,
+	}
+	requested := api.Permissions{
+		"metadata":      api.AccessLevelRead,
+		"contents":      api.AccessLevel(*accessFlag),
+		"pull_requests": api.AccessLevel(*accessFlag),
+	}
+	if err := requested.Validate(); err != nil {
+		log.Fatalf("invalid -access: %s", err.Error())
+	}
+
+	failed := false
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("unable to read %s: %s", file, err.Error())
+		}
+
+		gitops, problems := github.LintGitOps(string(contents), config.ConfigGitOps{}.FileFormat(file))
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", file, problem)
+			if problem.Severity == github.LintError {
+				failed = true
+			}
+		}
+		if gitops == nil || pipelineRepo == nil {
+			continue
+		}
+
+		permitted, listed := gitops.PermittedPermissions(*pipelineRepo, claims, requested)
+		if listed {
+			fmt.Printf("%s: %s is permitted: %v\n", file, pipelineRepo.HTTPS(), permitted)
+		} else {
+			fmt.Printf("%s: %s is not permitted\n", file, pipelineRepo.HTTPS())
+		}
+		for _, entry := range gitops.Trace(*pipelineRepo, claims) {
+			fmt.Printf("  %s (access %s): repository matches=%t, conditions match=%t\n",
+				entry.Repository, entry.Access, entry.RepositoryMatches, entry.ConditionsMatch)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -2,93 +2,43 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
-	"github.com/lestrrat-go/jwx/v2/jwk"
 	"go.uber.org/zap"
 
-	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
 	"github.com/moensch/buildkite-github-token-server/internal/config"
-	"github.com/moensch/buildkite-github-token-server/internal/github"
-	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
 	"github.com/moensch/buildkite-github-token-server/internal/server"
 )
 
-const (
-	jwksURL     = "https://agent.buildkite.com/.well-known/jwks"
-	jwtAudience = "https://buildkite.com/twilio-sandbox"
-	jwtIssuer   = "https://agent.buildkite.com"
-)
-
-var (
-	jwkCache *jwk.Cache
-	myctx    context.Context
-	bkClient *buildkite.Client
-	ghClient *github.Client
-)
-
-func allowRepoAccess(organizationSlug string, pipelineSlug string, requestedRepo repoparser.RepositoryName) (bool, error) {
-	if strings.HasSuffix(requestedRepo.Repo, "-buildkite-plugin") {
-		// Always allow access to buildkite plugin repos
-		return true, nil
-	}
-
-	// Check if the requested repo is associated with this pipeline
-	repo, err := bkClient.GetPipelineRepo(organizationSlug, pipelineSlug)
-	if err != nil {
-		return false, err
-	}
-	buildkitePipelineRepo, err := repoparser.ExtractOrgRepoFromURL(repo)
-	if err != nil {
-		return false, fmt.Errorf("cannot parse repo %s: %s", repo, err)
-	}
-
-	if buildkitePipelineRepo.Equals(requestedRepo) {
-		// Requested repo matches repo associated with pipeline that issued the token
-		return true, nil
-	}
-
-	// Check if the requested repo has a gitops.yaml file pointing back to our origin repo
-	contents, status, err := ghClient.GetContents(requestedRepo.Org, requestedRepo.Repo, "gitops.yaml")
-	if err != nil {
-		if status == http.StatusNotFound {
-			// Repo does not have a gitops.yaml file, allow access
-			log.Printf("WARNING: repo %s does not have a gitops.yaml - anyone can write to it", requestedRepo.HTTPS())
-			return true, nil
-		}
+func main() {
+	configFlag := flag.String("config", "./config.yaml", "path to the config file")
+	checkConfigFlag := flag.Bool("check-config", false, "validate the config file, including the private keys and other files it refers to, and exit")
+	flag.Parse()
 
-		// Other error getting gitops.yaml
-		return false, err
+	if *checkConfigFlag {
+		os.Exit(checkConfig(*configFlag))
 	}
 
-	// Repo has a gitops.yaml, parse it
-	gitops, err := github.GitOpsFromString(contents)
-	if err != nil {
-		return false, fmt.Errorf("cannot parse gitops.yaml in %s: %s", requestedRepo.HTTPS(), err)
-	}
-
-	// Return true if the repo associated with the pipeline that made the request
-	// is listed as permitted in the requested repo
-	return gitops.RepositoryPermitted(buildkitePipelineRepo), nil
-
-}
-
-func main() {
 	rootLogger, err := zap.NewDevelopment()
 	if err != nil {
 		log.Fatalf("cannot initialize root logger: %s", err)
 	}
-	cfg, err := config.NewConfig("./config.yaml")
+	cfg, err := config.NewConfig(*configFlag)
 	if err != nil {
 		rootLogger.Fatal("cannot load config", zap.Error(err))
 	}
-	rootLogger.Info("loaded configuration", zap.String("filepath", "./config.yaml"))
+	rootLogger.Info("loaded configuration", zap.String("filepath", *configFlag))
 
-	srv := server.New(*cfg)
+	srv, err := server.New(*cfg)
+	if err != nil {
+		rootLogger.Fatal("cannot create server", zap.Error(err))
+	}
 	err = srv.Initialize()
 	if err != nil {
 		rootLogger.Error("error initializing server",
@@ -97,6 +47,42 @@ func main() {
 		os.Exit(1)
 	}
 
-	// blocking call with log.Fatalf inside
-	srv.Serve()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// the first signal starts draining, restore the default handling so a second one exits immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	srv.WatchConfig(*configFlag, cfg.ConfigWatchInterval)
+
+	if err := srv.Run(ctx); err != nil {
+		rootLogger.Error("server stopped", zap.Error(err))
+		os.Exit(1)
+	}
+}
+
+// checkConfig prints every problem with a config file and returns the exit code
+func checkConfig(path string) int {
+	cfg, err := config.ReadConfig(path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+
+	var validationErr *config.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		fmt.Printf("%s: %d problem(s) found\n", path, len(validationErr.Problems))
+		for _, problem := range validationErr.Problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		return 1
+	case err != nil:
+		fmt.Printf("%s: %s\n", path, err)
+		return 1
+	default:
+		fmt.Printf("%s: ok\n", path)
+		return 0
+	}
 }
@@ -3,7 +3,6 @@ module github.com/moensch/buildkite-github-token-server
 go 1.19
 
 require (
-	github.com/bradleyfalzon/ghinstallation/v2 v2.1.0
 	github.com/go-chi/chi v1.5.4
 	github.com/gobwas/glob v0.2.3
 	github.com/google/go-github/v48 v48.2.0
@@ -20,14 +19,13 @@ require (
 )
 
 require (
+	github.com/benbjohnson/clock v1.1.0 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.1.0 // indirect
 	github.com/goccy/go-json v0.10.0 // indirect
-	github.com/golang-jwt/jwt/v4 v4.4.3 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/google/go-github/v45 v45.2.0 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/lestrrat-go/blackmagic v1.0.1 // indirect
@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// defaultHTTPTimeout limits how long an http sink waits for a response
+const defaultHTTPTimeout = 5 * time.Second
+
+// Event types
+const (
+	EventTokenRequest = "token.request"
+	EventTokenRevoke  = "token.revoke"
+	EventTokenExplain = "token.explain"
+)
+
+// Outcomes of an audited request
+const (
+	OutcomeIssued  = "issued"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+	OutcomeRevoked = "revoked"
+
+	// OutcomeExplained is the outcome of explain requests, Reason holds why a token would be refused
+	OutcomeExplained = "explained"
+)
+
+// Event is a single audit record, written as one JSON object per request
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	RequestID string    `json:"req_id"`
+	Outcome   string    `json:"outcome"`
+
+	// Status is the HTTP status code returned to the caller
+	Status int `json:"status"`
+
+	// Reason explains denials and errors
+	Reason string `json:"reason,omitempty"`
+
+	// Claims are the verified Buildkite OIDC token claims, unset if the token could not be verified
+	Claims *buildkite.Claims `json:"claims,omitempty"`
+
+	Repositories         []string                 `json:"repositories,omitempty"`
+	RequestedPermissions api.Permissions          `json:"requested_permissions,omitempty"`
+	GrantedPermissions   api.Permissions          `json:"granted_permissions,omitempty"`
+	Decisions            []api.RepositoryDecision `json:"decisions,omitempty"`
+	Tokens               []Token                  `json:"tokens,omitempty"`
+}
+
+// Token describes an issued or revoked token without revealing it
+type Token struct {
+	Host         string    `json:"host"`
+	Organization string    `json:"organization"`
+	Repositories []string  `json:"repositories,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Fingerprint  string    `json:"fingerprint"`
+}
+
+// Fingerprint returns a stable, non-reversible identifier of a token, which can be matched
+// against GitHub's audit log or a leaked token without storing the token itself
+func Fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("sha256:%s", hex.EncodeToString(sum[:]))
+}
+
+// Sink receives audit events
+type Sink interface {
+	Write(event *Event) error
+	Close() error
+}
+
+// Multi writes every event to all of its sinks
+type Multi []Sink
+
+// Write writes the event to all sinks, even if some of them fail
+func (m Multi) Write(event *Event) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("cannot write audit event", errs)
+}
+
+// Close closes all sinks
+func (m Multi) Close() error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("cannot close audit sinks", errs)
+}
+
+func joinErrors(msg string, errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s: %w", msg, errs[0])
+	default:
+		return fmt.Errorf("%s: %w (and %d more errors)", msg, errs[0], len(errs)-1)
+	}
+}
+
+// NewSinkFromConfig creates all configured sinks
+func NewSinkFromConfig(logger *zap.Logger, cfg config.ConfigAudit) (Multi, error) {
+	sinks := make(Multi, 0, len(cfg.Sinks))
+	for _, sinkConfig := range cfg.Sinks {
+		switch sinkConfig.Type {
+		case "file":
+			sink, err := NewFileSink(sinkConfig.Path, sinkConfig.MaxSizeMB*1024*1024, sinkConfig.MaxBackups)
+			if err != nil {
+				_ = sinks.Close()
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "stdout":
+			sinks = append(sinks, NewWriterSink(os.Stdout))
+		case "http":
+			timeout := sinkConfig.Timeout
+			if timeout == 0 {
+				timeout = defaultHTTPTimeout
+			}
+			sinks = append(sinks, NewHTTPSink(logger, sinkConfig.URL, timeout))
+		default:
+			_ = sinks.Close()
+			return nil, fmt.Errorf("unknown audit sink type '%s'", sinkConfig.Type)
+		}
+	}
+	return sinks, nil
+}
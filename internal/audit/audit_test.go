@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+func testEvent(requestID string) *Event {
+	return &Event{
+		Time:         time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC),
+		Type:         EventTokenRequest,
+		RequestID:    requestID,
+		Outcome:      OutcomeIssued,
+		Status:       http.StatusOK,
+		Claims:       &buildkite.Claims{JobID: "job1", OrganizationSlug: "myorg", PipelineSlug: "mypipeline"},
+		Repositories: []string{"https://github.com/myorg/myrepo.git"},
+		RequestedPermissions: api.Permissions{
+			"contents": api.AccessLevelWrite,
+		},
+		Tokens: []Token{
+			{Host: "github.com", Organization: "myorg", Fingerprint: Fingerprint("ghs_secret")},
+		},
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t, Fingerprint("ghs_secret"), Fingerprint("ghs_secret"))
+	assert.NotEqual(t, Fingerprint("ghs_secret"), Fingerprint("ghs_other"))
+	assert.True(t, strings.HasPrefix(Fingerprint("ghs_secret"), "sha256:"))
+	assert.NotContains(t, Fingerprint("ghs_secret"), "ghs_secret")
+}
+
+func TestWriterSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewWriterSink(buf)
+	require.NoError(t, sink.Write(testEvent("req1")))
+	require.NoError(t, sink.Write(testEvent("req2")))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var event Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, "req2", event.RequestID)
+	assert.Equal(t, "job1", event.Claims.JobID)
+	assert.NotContains(t, buf.String(), "ghs_secret")
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	line, err := marshalLine(testEvent("req0"))
+	require.NoError(t, err)
+
+	// room for two events per file
+	sink, err := NewFileSink(path, int64(len(line)*2), 2)
+	require.NoError(t, err)
+	for _, id := range []string{"req0", "req1", "req2", "req3", "req4", "req5", "req6"} {
+		require.NoError(t, sink.Write(testEvent(id)))
+	}
+	require.NoError(t, sink.Close())
+
+	readIDs := func(path string) []string {
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+		ids := make([]string, 0)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event Event
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			ids = append(ids, event.RequestID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"req6"}, readIDs(path))
+	assert.Equal(t, []string{"req4", "req5"}, readIDs(path+".1"))
+	assert.Equal(t, []string{"req2", "req3"}, readIDs(path+".2"))
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestHTTPSink(t *testing.T) {
+	received := make(chan Event, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	// writes return while the endpoint is still busy
+	sink := NewHTTPSink(zaptest.NewLogger(t), srv.URL, time.Second)
+	require.NoError(t, sink.Write(testEvent("req1")))
+	close(release)
+	assert.Equal(t, "req1", (<-received).RequestID)
+	require.NoError(t, sink.Close())
+	assert.Error(t, sink.Write(testEvent("req2")))
+
+	// failed sends are logged once the queue is drained
+	core, logs := observer.New(zap.ErrorLevel)
+	failing := NewHTTPSink(zap.New(core), srv.URL+"/nowhere", time.Second)
+	srv.Config.Handler = http.NotFoundHandler()
+	require.NoError(t, failing.Write(testEvent("req3")))
+	require.NoError(t, failing.Close())
+	require.Equal(t, 1, logs.FilterMessage("cannot send audit event").Len())
+}
+
+func TestNewSinkFromConfig(t *testing.T) {
+	sinks, err := NewSinkFromConfig(zaptest.NewLogger(t), config.ConfigAudit{
+		Sinks: []*config.ConfigAuditSink{
+			{Type: "file", Path: filepath.Join(t.TempDir(), "audit.jsonl")},
+			{Type: "stdout"},
+			{Type: "http", URL: "http://localhost:9880/audit"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, sinks, 3)
+	require.NoError(t, sinks.Close())
+
+	_, err = NewSinkFromConfig(zaptest.NewLogger(t), config.ConfigAudit{
+		Sinks: []*config.ConfigAuditSink{{Type: "syslog"}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,213 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WriterSink writes events as JSON lines to a writer, such as os.Stdout
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(event *Event) error {
+	line, err := marshalLine(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink appends events as JSON lines to a file. Once the file exceeds MaxSize bytes it is rotated
+// to <path>.1, <path>.1 to <path>.2 and so on, keeping at most MaxBackups old files.
+type FileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens or creates the file at path for appending
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log %s: %w", s.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat audit log %s: %w", s.Path, err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(event *Event) error {
+	line, err := marshalLine(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups by one, moves the current file to <path>.1 and opens a new file
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("cannot close audit log %s: %w", s.Path, err)
+	}
+	if s.MaxBackups > 0 {
+		for idx := s.MaxBackups - 1; idx > 0; idx-- {
+			// older backups may not exist yet
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.Path, idx), fmt.Sprintf("%s.%d", s.Path, idx+1))
+		}
+		if err := os.Rename(s.Path, fmt.Sprintf("%s.1", s.Path)); err != nil {
+			return fmt.Errorf("cannot rotate audit log %s: %w", s.Path, err)
+		}
+	} else if err := os.Remove(s.Path); err != nil {
+		return fmt.Errorf("cannot rotate audit log %s: %w", s.Path, err)
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// httpQueueSize is how many events an http sink buffers while the endpoint is slow or unavailable
+const httpQueueSize = 1024
+
+// HTTPSink posts each event as JSON to a URL, such as a local log shipper. Events are queued and sent
+// in the background so requests do not wait on the endpoint, failed sends are logged and dropped.
+type HTTPSink struct {
+	URL    string
+	Client *http.Client
+
+	logger *zap.Logger
+	queue  chan *Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewHTTPSink starts the background sender of the sink, Close stops it
+func NewHTTPSink(logger *zap.Logger, url string, timeout time.Duration) *HTTPSink {
+	s := &HTTPSink{
+		URL:    url,
+		Client: &http.Client{Timeout: timeout},
+		logger: logger,
+		queue:  make(chan *Event, httpQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *HTTPSink) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		if err := s.send(event); err != nil {
+			s.logger.Error("cannot send audit event", zap.String("request_id", event.RequestID), zap.Error(err))
+		}
+	}
+}
+
+// Write queues the event, it only fails if the queue is full or the sink is closed
+func (s *HTTPSink) Write(event *Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit sink %s is closed", s.URL)
+	}
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("audit queue of %s is full, dropping event", s.URL)
+	}
+}
+
+func (s *HTTPSink) send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit event: %w", err)
+	}
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cannot send audit event: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit endpoint %s responded with %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// Close sends the queued events and stops the background sender
+func (s *HTTPSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func marshalLine(event *Event) ([]byte, error) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode audit event: %w", err)
+	}
+	return append(line, '\n'), nil
+}
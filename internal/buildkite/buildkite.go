@@ -3,9 +3,12 @@ package buildkite
 import (
 	"context"
 	"fmt"
+	"time"
 
 	graphql "github.com/shurcooL/graphql"
 	"golang.org/x/oauth2"
+
+	"github.com/moensch/buildkite-github-token-server/internal/cache"
 )
 
 const (
@@ -15,6 +18,9 @@ const (
 // Client is a buildkite client for querying agent metrics and the buildkite GraphQL API
 type Client struct {
 	GraphQL *graphql.Client
+
+	// pipelineRepos caches pipeline to repository lookups, keyed by org/pipeline
+	pipelineRepos *cache.Cache[string, string]
 }
 
 // NewClient instantiates a new client
@@ -28,7 +34,23 @@ func NewClient(token string) *Client {
 	}
 }
 
+// WithPipelineCache enables caching of pipeline to repository lookups for ttl, holding at most size pipelines
+func (c *Client) WithPipelineCache(ttl time.Duration, size int) *Client {
+	c.pipelineRepos = cache.New[string, string]("buildkite_pipeline_repo", ttl, size)
+	return c
+}
+
+// GetPipelineRepo returns the repository URL a pipeline builds
 func (c *Client) GetPipelineRepo(organizationSlug string, pipelineSlug string) (repo string, err error) {
+	if c.pipelineRepos == nil {
+		return c.queryPipelineRepo(organizationSlug, pipelineSlug)
+	}
+	return c.pipelineRepos.Get(fmt.Sprintf("%s/%s", organizationSlug, pipelineSlug), func() (string, error) {
+		return c.queryPipelineRepo(organizationSlug, pipelineSlug)
+	})
+}
+
+func (c *Client) queryPipelineRepo(organizationSlug string, pipelineSlug string) (repo string, err error) {
 	var q struct {
 		Pipeline struct {
 			Repository struct {
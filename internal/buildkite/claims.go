@@ -0,0 +1,88 @@
+package buildkite
+
+import (
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Claims holds the Buildkite specific claims of a verified OIDC token.
+// See https://buildkite.com/docs/agent/v3/cli-oidc
+type Claims struct {
+	JobID            string `json:"job_id"`
+	OrganizationSlug string `json:"organization_slug"`
+	PipelineSlug     string `json:"pipeline_slug"`
+
+	BuildNumber       int64  `json:"build_number"`
+	BuildBranch       string `json:"build_branch,omitempty"`
+	BuildTag          string `json:"build_tag,omitempty"`
+	BuildCommit       string `json:"build_commit,omitempty"`
+	BuildSource       string `json:"build_source,omitempty"`
+	StepKey           string `json:"step_key,omitempty"`
+	AgentID           string `json:"agent_id,omitempty"`
+	RunnerEnvironment string `json:"runner_environment,omitempty"`
+
+	// QueueKey is only set if the agent requested the optional queue_key claim
+	QueueKey string `json:"queue_key,omitempty"`
+
+	// Raw holds all Buildkite specific claims in string form, including optional ones such as agent_tag:<name>
+	Raw map[string]string `json:"raw,omitempty"`
+}
+
+// ClaimsFromToken extracts the Buildkite claims from a verified OIDC token. job_id, organization_slug
+// and pipeline_slug are required.
+func ClaimsFromToken(token jwt.Token) (Claims, error) {
+	claims := Claims{}
+	required := map[string]*string{
+		"job_id":            &claims.JobID,
+		"organization_slug": &claims.OrganizationSlug,
+		"pipeline_slug":     &claims.PipelineSlug,
+	}
+	optional := map[string]*string{
+		"build_branch":       &claims.BuildBranch,
+		"build_tag":          &claims.BuildTag,
+		"build_commit":       &claims.BuildCommit,
+		"build_source":       &claims.BuildSource,
+		"step_key":           &claims.StepKey,
+		"agent_id":           &claims.AgentID,
+		"runner_environment": &claims.RunnerEnvironment,
+		"queue_key":          &claims.QueueKey,
+	}
+
+	for name, dst := range required {
+		value, exists := token.Get(name)
+		if !exists {
+			return claims, fmt.Errorf("missing %s", name)
+		}
+		str, ok := value.(string)
+		if !ok {
+			return claims, fmt.Errorf("claim %s is not a string", name)
+		}
+		*dst = str
+	}
+	for name, dst := range optional {
+		if value, exists := token.Get(name); exists && value != nil {
+			str, ok := value.(string)
+			if !ok {
+				return claims, fmt.Errorf("claim %s is not a string", name)
+			}
+			*dst = str
+		}
+	}
+	if value, exists := token.Get("build_number"); exists {
+		number, ok := value.(float64)
+		if !ok {
+			return claims, fmt.Errorf("claim build_number is not a number")
+		}
+		claims.BuildNumber = int64(number)
+	}
+
+	claims.Raw = make(map[string]string)
+	for name, value := range token.PrivateClaims() {
+		if value != nil {
+			claims.Raw[name] = fmt.Sprint(value)
+		}
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,62 @@
+package buildkite
+
+import (
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimsFromToken(t *testing.T) {
+	newToken := func(claims map[string]interface{}) jwt.Token {
+		token := jwt.New()
+		for name, value := range claims {
+			require.NoError(t, token.Set(name, value))
+		}
+		return token
+	}
+
+	t.Run("happyPath", func(t *testing.T) {
+		claims, err := ClaimsFromToken(newToken(map[string]interface{}{
+			"job_id":            "0184990a-477b-4fa8-9968-496074483cee",
+			"organization_slug": "myorg",
+			"pipeline_slug":     "mypipeline",
+			"build_number":      float64(42),
+			"build_branch":      "main",
+			"build_source":      "webhook",
+			"step_key":          "deploy",
+			"agent_tag:queue":   "default",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, "myorg", claims.OrganizationSlug)
+		assert.Equal(t, "mypipeline", claims.PipelineSlug)
+		assert.Equal(t, int64(42), claims.BuildNumber)
+		assert.Equal(t, "main", claims.BuildBranch)
+		assert.Equal(t, "webhook", claims.BuildSource)
+		assert.Equal(t, "deploy", claims.StepKey)
+		assert.Equal(t, "default", claims.Raw["agent_tag:queue"])
+	})
+
+	t.Run("missingJobID", func(t *testing.T) {
+		_, err := ClaimsFromToken(newToken(map[string]interface{}{
+			"organization_slug": "myorg",
+			"pipeline_slug":     "mypipeline",
+		}))
+		require.Error(t, err)
+	})
+}
+
+func TestClaimConditions(t *testing.T) {
+	conditions := ClaimConditions{
+		Branches:     []string{"main", "release/*"},
+		BuildSources: []string{"webhook"},
+		Claims:       map[string][]string{"agent_tag:queue": {"trusted-*"}},
+	}
+	require.NoError(t, conditions.Compile())
+
+	assert.True(t, conditions.Matches(Claims{BuildBranch: "release/1.0", BuildSource: "webhook", Raw: map[string]string{"agent_tag:queue": "trusted-linux"}}))
+	assert.False(t, conditions.Matches(Claims{BuildBranch: "feature", BuildSource: "webhook", Raw: map[string]string{"agent_tag:queue": "trusted-linux"}}))
+	assert.False(t, conditions.Matches(Claims{BuildBranch: "main", BuildSource: "webhook"}))
+	assert.True(t, ClaimConditions{}.Matches(Claims{}))
+}
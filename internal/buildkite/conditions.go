@@ -0,0 +1,127 @@
+package buildkite
+
+import (
+	"fmt"
+
+	"github.com/gobwas/glob"
+)
+
+// ClaimConditions restricts something to builds whose OIDC claims match. Every field is a list of
+// globs, an empty list matches anything. All fields must match.
+type ClaimConditions struct {
+	// Organizations are matched against organization_slug
+	Organizations []string `yaml:"organizations,omitempty" json:"organizations,omitempty"`
+
+	// Pipelines are matched against pipeline_slug
+	Pipelines []string `yaml:"pipelines,omitempty" json:"pipelines,omitempty"`
+
+	// Branches are matched against build_branch
+	Branches []string `yaml:"branches,omitempty" json:"branches,omitempty"`
+
+	// BuildSources are matched against build_source (e.g. webhook, api, ui, trigger_job, schedule)
+	BuildSources []string `yaml:"buildSources,omitempty" json:"buildSources,omitempty"`
+
+	// StepKeys are matched against step_key
+	StepKeys []string `yaml:"stepKeys,omitempty" json:"stepKeys,omitempty"`
+
+	// Queues are matched against the optional queue_key claim
+	Queues []string `yaml:"queues,omitempty" json:"queues,omitempty"`
+
+	// Claims matches any other claim by name, for example agent_tag:os
+	Claims map[string][]string `yaml:"claims,omitempty" json:"claims,omitempty"`
+
+	organizations []glob.Glob
+	pipelines     []glob.Glob
+	branches      []glob.Glob
+	buildSources  []glob.Glob
+	stepKeys      []glob.Glob
+	queues        []glob.Glob
+	claims        map[string][]glob.Glob
+}
+
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	globs := make([]glob.Glob, len(patterns))
+	for idx, pattern := range patterns {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		globs[idx] = g
+	}
+	return globs, nil
+}
+
+// matchAny returns true if there are no globs, or any of them matches the value
+func matchAny(globs []glob.Glob, value string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if g.Match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile compiles all patterns. It must be called before Matches.
+func (c *ClaimConditions) Compile() (err error) {
+	if c.organizations, err = compileGlobs(c.Organizations); err != nil {
+		return err
+	}
+	if c.pipelines, err = compileGlobs(c.Pipelines); err != nil {
+		return err
+	}
+	if c.branches, err = compileGlobs(c.Branches); err != nil {
+		return err
+	}
+	if c.buildSources, err = compileGlobs(c.BuildSources); err != nil {
+		return err
+	}
+	if c.stepKeys, err = compileGlobs(c.StepKeys); err != nil {
+		return err
+	}
+	if c.queues, err = compileGlobs(c.Queues); err != nil {
+		return err
+	}
+	c.claims = nil
+	for name, patterns := range c.Claims {
+		globs, err := compileGlobs(patterns)
+		if err != nil {
+			return fmt.Errorf("claim %s: %w", name, err)
+		}
+		if c.claims == nil {
+			c.claims = make(map[string][]glob.Glob)
+		}
+		c.claims[name] = globs
+	}
+	return nil
+}
+
+// Empty returns true if there are no conditions
+func (c ClaimConditions) Empty() bool {
+	return len(c.Organizations) == 0 && len(c.Pipelines) == 0 && len(c.Branches) == 0 &&
+		len(c.BuildSources) == 0 && len(c.StepKeys) == 0 && len(c.Queues) == 0 && len(c.Claims) == 0
+}
+
+// Matches returns true if the claims satisfy all conditions
+func (c ClaimConditions) Matches(claims Claims) bool {
+	if !matchAny(c.organizations, claims.OrganizationSlug) ||
+		!matchAny(c.pipelines, claims.PipelineSlug) ||
+		!matchAny(c.branches, claims.BuildBranch) ||
+		!matchAny(c.buildSources, claims.BuildSource) ||
+		!matchAny(c.stepKeys, claims.StepKey) ||
+		!matchAny(c.queues, claims.QueueKey) {
+		return false
+	}
+	for name, globs := range c.claims {
+		value, ok := claims.Raw[name]
+		if !ok || !matchAny(globs, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package buildkite
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookMaxAge is how old a signed webhook may be before it is rejected as a possible replay
+	webhookMaxAge = 5 * time.Minute
+
+	// WebhookEventJobFinished is sent when a job completes, regardless of its outcome
+	WebhookEventJobFinished = "job.finished"
+)
+
+// WebhookVerifier authenticates Buildkite webhooks either by their plain text token or by their HMAC signature
+type WebhookVerifier struct {
+	// Token is compared to the X-Buildkite-Token header
+	Token string
+
+	// Secret is the key of the X-Buildkite-Signature header's HMAC-SHA256 signature
+	Secret string
+
+	// now is overridable for tests
+	now func() time.Time
+}
+
+// WebhookEvent is the subset of a Buildkite webhook payload this service uses
+type WebhookEvent struct {
+	Event string `json:"event"`
+	Job   struct {
+		ID    string `json:"id"`
+		State string `json:"state"`
+	} `json:"job"`
+	Pipeline struct {
+		Slug string `json:"slug"`
+	} `json:"pipeline"`
+}
+
+// Verify checks the request headers authenticate the webhook body
+func (v *WebhookVerifier) Verify(header http.Header, body []byte) error {
+	if v.Secret != "" {
+		if signature := header.Get("X-Buildkite-Signature"); signature != "" {
+			return v.verifySignature(signature, body)
+		}
+	}
+	if v.Token != "" {
+		token := header.Get("X-Buildkite-Token")
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(v.Token)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook is neither signed nor has a valid token")
+}
+
+// verifySignature checks a "timestamp=<unix>,signature=<hex>" header, which signs "<timestamp>.<body>"
+func (v *WebhookVerifier) verifySignature(header string, body []byte) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "timestamp":
+			timestamp = value
+		case "signature":
+			signature = value
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("malformed webhook signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature timestamp: %w", err)
+	}
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+	if age := now().Sub(time.Unix(unix, 0)); age > webhookMaxAge || age < -webhookMaxAge {
+		return fmt.Errorf("webhook signature timestamp is %s off", age.Round(time.Second))
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, []byte(v.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return fmt.Errorf("webhook signature does not match")
+	}
+	return nil
+}
+
+// ParseWebhookEvent decodes a webhook payload
+func ParseWebhookEvent(body []byte) (*WebhookEvent, error) {
+	event := &WebhookEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, fmt.Errorf("cannot parse webhook payload: %w", err)
+	}
+	return event, nil
+}
@@ -0,0 +1,88 @@
+package buildkite
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookVerifier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"job.finished","job":{"id":"0184990a-477b-4fa8-9968-496074483cee","state":"passed"}}`)
+	sign := func(secret string, timestamp int64) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, body)))
+		return fmt.Sprintf("timestamp=%d,signature=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	tests := []struct {
+		name     string
+		verifier WebhookVerifier
+		header   http.Header
+		wantErr  bool
+	}{
+		{
+			name:     "valid token",
+			verifier: WebhookVerifier{Token: "s3cr3t"},
+			header:   http.Header{"X-Buildkite-Token": {"s3cr3t"}},
+		},
+		{
+			name:     "invalid token",
+			verifier: WebhookVerifier{Token: "s3cr3t"},
+			header:   http.Header{"X-Buildkite-Token": {"wrong"}},
+			wantErr:  true,
+		},
+		{
+			name:     "valid signature",
+			verifier: WebhookVerifier{Secret: "s3cr3t"},
+			header:   http.Header{"X-Buildkite-Signature": {sign("s3cr3t", now.Unix())}},
+		},
+		{
+			name:     "wrong secret",
+			verifier: WebhookVerifier{Secret: "s3cr3t"},
+			header:   http.Header{"X-Buildkite-Signature": {sign("wrong", now.Unix())}},
+			wantErr:  true,
+		},
+		{
+			name:     "stale signature",
+			verifier: WebhookVerifier{Secret: "s3cr3t"},
+			header:   http.Header{"X-Buildkite-Signature": {sign("s3cr3t", now.Add(-time.Hour).Unix())}},
+			wantErr:  true,
+		},
+		{
+			name:     "signature not configured",
+			verifier: WebhookVerifier{Token: "s3cr3t"},
+			header:   http.Header{"X-Buildkite-Signature": {sign("s3cr3t", now.Unix())}},
+			wantErr:  true,
+		},
+		{
+			name:     "no credentials",
+			verifier: WebhookVerifier{Token: "s3cr3t", Secret: "s3cr3t"},
+			header:   http.Header{},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.verifier.now = func() time.Time { return now }
+			err := tt.verifier.Verify(tt.header, body)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	event, err := ParseWebhookEvent(body)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookEventJobFinished, event.Event)
+	assert.Equal(t, "0184990a-477b-4fa8-9968-496074483cee", event.Job.ID)
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/moensch/buildkite-github-token-server/internal/metrics"
+)
+
+// Cache is a size-bounded, least recently used TTL cache. Concurrent misses for the same key are
+// coalesced into a single load.
+type Cache[K comparable, V any] struct {
+	name    string
+	ttl     time.Duration
+	maxSize int
+
+	mu       sync.Mutex
+	entries  map[K]*list.Element
+	lru      *list.List
+	inflight map[K]*call[V]
+
+	// now is overridable for tests
+	now func() time.Time
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// call is a load in progress which other callers wait for
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// New returns a cache. name is used as the metrics label, a maxSize of 0 or less means unbounded.
+func New[K comparable, V any](name string, ttl time.Duration, maxSize int) *Cache[K, V] {
+	return &Cache[K, V]{
+		name:     name,
+		ttl:      ttl,
+		maxSize:  maxSize,
+		entries:  make(map[K]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[K]*call[V]),
+		now:      time.Now,
+	}
+}
+
+// Loader fetches the value of a key. stale is the expired previous value, or nil if there is none,
+// which allows revalidating instead of fetching from scratch. It returns the value and how long it may
+// be cached for.
+type Loader[V any] func(stale *V) (V, time.Duration, error)
+
+// Get returns the cached value for key, or calls load to fetch it. Errors are not cached.
+func (c *Cache[K, V]) Get(key K, load func() (V, error)) (V, error) {
+	return c.Load(key, func(_ *V) (V, time.Duration, error) {
+		value, err := load()
+		return value, c.ttl, err
+	})
+}
+
+// Load returns the cached value for key, or calls load to fetch or revalidate it. Errors are not cached.
+func (c *Cache[K, V]) Load(key K, load Loader[V]) (V, error) {
+	var stale *V
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		if c.now().Before(e.expiresAt) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			c.observe("hit")
+			return e.value, nil
+		}
+		staleValue := e.value
+		stale = &staleValue
+	}
+
+	if inflight, ok := c.inflight[key]; ok {
+		// Someone else is already loading this key, wait for their result
+		c.mu.Unlock()
+		c.observe("coalesced")
+		<-inflight.done
+		return inflight.value, inflight.err
+	}
+
+	cl := &call[V]{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+	if stale != nil {
+		c.observe("stale")
+	} else {
+		c.observe("miss")
+	}
+
+	c.load(key, cl, stale, load)
+	return cl.value, cl.err
+}
+
+// load runs a loader for an inflight call and stores its result. A panicking loader fails the call instead of
+// leaving callers waiting for it forever.
+func (c *Cache[K, V]) load(key K, cl *call[V], stale *V, load Loader[V]) {
+	var ttl time.Duration
+	defer func() {
+		if r := recover(); r != nil {
+			var zero V
+			cl.value, cl.err = zero, fmt.Errorf("loading %s cache entry panicked: %v", c.name, r)
+		}
+
+		c.mu.Lock()
+		delete(c.inflight, key)
+		if cl.err == nil {
+			c.set(key, cl.value, ttl)
+		} else if elem, ok := c.entries[key]; ok {
+			// do not keep serving an expired value which could not be revalidated
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+
+	cl.value, ttl, cl.err = load(stale)
+}
+
+// Len returns the number of cached entries, including expired ones kept for revalidation
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// set stores a value, evicting the least recently used entry if the cache is full. Must hold c.mu.
+func (c *Cache[K, V]) set(key K, value V, ttl time.Duration) {
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&entry[K, V]{
+		key:       key,
+		value:     value,
+		expiresAt: c.now().Add(ttl),
+	})
+	for c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+		metrics.PromMetrics.CacheEvictions.With(prometheus.Labels{"cache": c.name}).Inc()
+	}
+	metrics.PromMetrics.CacheSize.With(prometheus.Labels{"cache": c.name}).Set(float64(c.lru.Len()))
+}
+
+// remove drops an entry. Must hold c.mu.
+func (c *Cache[K, V]) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*entry[K, V]).key)
+}
+
+func (c *Cache[K, V]) observe(result string) {
+	metrics.PromMetrics.CacheRequests.With(prometheus.Labels{"cache": c.name, "result": result}).Inc()
+}
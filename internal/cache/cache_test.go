@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGet(t *testing.T) {
+	now := time.Now()
+	c := New[string, string]("test", time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	var loads int
+	load := func(value string) func() (string, error) {
+		return func() (string, error) {
+			loads++
+			return value, nil
+		}
+	}
+
+	t.Run("missThenHit", func(t *testing.T) {
+		v, err := c.Get("a", load("1"))
+		require.NoError(t, err)
+		assert.Equal(t, "1", v)
+		v, err = c.Get("a", load("2"))
+		require.NoError(t, err)
+		assert.Equal(t, "1", v)
+		assert.Equal(t, 1, loads)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		v, err := c.Get("a", load("3"))
+		require.NoError(t, err)
+		assert.Equal(t, "3", v)
+		assert.Equal(t, 2, loads)
+	})
+
+	t.Run("errorsNotCached", func(t *testing.T) {
+		_, err := c.Get("b", func() (string, error) { return "", errors.New("boom") })
+		require.Error(t, err)
+		v, err := c.Get("b", load("4"))
+		require.NoError(t, err)
+		assert.Equal(t, "4", v)
+	})
+
+	t.Run("sizeBound", func(t *testing.T) {
+		_, err := c.Get("c", load("5"))
+		require.NoError(t, err)
+		assert.Equal(t, 2, c.Len())
+		// "a" was least recently used and has been evicted
+		v, err := c.Get("a", load("6"))
+		require.NoError(t, err)
+		assert.Equal(t, "6", v)
+	})
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	c := New[string, string]("test", time.Minute, 0)
+
+	var loads int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get("key", func() (string, error) {
+				atomic.AddInt32(&loads, 1)
+				<-release
+				return "value", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "value", v)
+		}()
+	}
+	// give the goroutines a moment to pile up behind the first load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+}
+
+func TestCacheLoad(t *testing.T) {
+	now := time.Now()
+	c := New[string, string]("test", time.Minute, 0)
+	c.now = func() time.Time { return now }
+
+	v, err := c.Load("key", func(stale *string) (string, time.Duration, error) {
+		assert.Nil(t, stale)
+		return "v1", 10 * time.Second, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "v1", v)
+
+	// entry-specific TTL has passed, the loader gets the stale value to revalidate
+	now = now.Add(11 * time.Second)
+	v, err = c.Load("key", func(stale *string) (string, time.Duration, error) {
+		require.NotNil(t, stale)
+		assert.Equal(t, "v1", *stale)
+		return *stale + "-revalidated", time.Minute, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "v1-revalidated", v)
+
+	// failed revalidation drops the stale entry
+	now = now.Add(2 * time.Minute)
+	_, err = c.Load("key", func(stale *string) (string, time.Duration, error) {
+		return "", 0, errors.New("boom")
+	})
+	require.Error(t, err)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCacheLoadPanic(t *testing.T) {
+	c := New[string, string]("test", time.Minute, 0)
+
+	_, err := c.Get("a", func() (string, error) {
+		panic("boom")
+	})
+	assert.ErrorContains(t, err, "boom")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v, err := c.Get("a", func() (string, error) { return "1", nil })
+		assert.NoError(t, err)
+		assert.Equal(t, "1", v)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("load after a panicking load did not return")
+	}
+}
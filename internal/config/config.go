@@ -1,15 +1,39 @@
 package config
 
 import (
+	"crypto"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"gopkg.in/yaml.v2"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+)
+
+const (
+	// DefaultIssuer is the issuer of Buildkite agent OIDC tokens
+	DefaultIssuer = "https://agent.buildkite.com"
+
+	// DefaultJWKSURL is where Buildkite publishes the keys OIDC tokens are signed with
+	DefaultJWKSURL = "https://agent.buildkite.com/.well-known/jwks"
 )
 
+// DefaultPermissionCeiling is the most a token request may ask for when no permissionCeiling is configured
+var DefaultPermissionCeiling = api.Permissions{
+	"metadata":      api.AccessLevelRead,
+	"contents":      api.AccessLevelWrite,
+	"pull_requests": api.AccessLevelWrite,
+	"checks":        api.AccessLevelWrite,
+	"statuses":      api.AccessLevelWrite,
+	"issues":        api.AccessLevelWrite,
+	"packages":      api.AccessLevelRead,
+}
+
 // Config holds all configurable values needed to run this service
 type Config struct {
 	// Port specifies the network port to listen on
@@ -19,12 +43,67 @@ type Config struct {
 	LogLevel string `envconfig:"LOG_LEVEL" required:"false" default:"debug"`
 
 	// BuildkiteToken is a Buildkite API key with GraphQL access
-	BuildkiteToken string `envconfig:"BUILDKITE_TOKEN" required:"true"`
+	BuildkiteToken string `envconfig:"BUILDKITE_TOKEN" required:"false"`
+
+	// WebhookToken enables /webhooks/buildkite for webhooks carrying this X-Buildkite-Token
+	WebhookToken string `envconfig:"BUILDKITE_WEBHOOK_TOKEN" required:"false"`
+
+	// WebhookSecret enables /webhooks/buildkite for webhooks signed with this secret
+	WebhookSecret string `envconfig:"BUILDKITE_WEBHOOK_SECRET" required:"false"`
+
+	// ConfigWatchInterval is how often the config file is checked for changes to reload, 0 only reloads on SIGHUP
+	ConfigWatchInterval time.Duration `envconfig:"CONFIG_WATCH_INTERVAL" required:"false" default:"10s"`
+
+	// ShutdownDelay is how long the server keeps serving after SIGTERM while /readyz reports it is draining,
+	// so load balancers stop routing to it before it stops accepting connections
+	ShutdownDelay time.Duration `envconfig:"SHUTDOWN_DELAY" required:"false" default:"5s"`
+
+	// ShutdownDrainTimeout is how long requests in flight may take to finish before they are dropped on shutdown
+	ShutdownDrainTimeout time.Duration `envconfig:"SHUTDOWN_DRAIN_TIMEOUT" required:"false" default:"30s"`
 
 	// Application holds the GitHub app configs
 	Applications []*ConfigApplication `yaml:"applications"`
 
 	ContextTimeout time.Duration `envconfig:"DEFAULT_TIMEOUT" required:"false" default:"30s"`
+
+	// PipelineCacheTTL is how long Buildkite pipeline to repository lookups are cached, 0 disables the cache
+	PipelineCacheTTL time.Duration `envconfig:"PIPELINE_CACHE_TTL" required:"false" default:"5m"`
+
+	// PipelineCacheSize is the maximum number of pipelines held in the cache
+	PipelineCacheSize int `envconfig:"PIPELINE_CACHE_SIZE" required:"false" default:"1000"`
+
+	// GitOpsCacheTTL is how long a parsed gitops.yaml is used before it is revalidated, 0 disables the cache
+	GitOpsCacheTTL time.Duration `envconfig:"GITOPS_CACHE_TTL" required:"false" default:"1m"`
+
+	// GitOpsNotFoundTTL is how long the absence of a gitops.yaml is cached
+	GitOpsNotFoundTTL time.Duration `envconfig:"GITOPS_NOT_FOUND_TTL" required:"false" default:"30s"`
+
+	// GitOpsCacheSize is the maximum number of repositories held in the gitops.yaml cache
+	GitOpsCacheSize int `envconfig:"GITOPS_CACHE_SIZE" required:"false" default:"5000"`
+
+	// Audiences are the accepted OIDC token audiences for issuers which do not list their own,
+	// e.g. https://buildkite.com/<organization slug>
+	Audiences []string `yaml:"audiences" envconfig:"OIDC_AUDIENCES" required:"false"`
+
+	// Issuers are the trusted OIDC token issuers, each issuer may only be configured once. Defaults to the Buildkite agent issuer.
+	Issuers []*ConfigIssuer `yaml:"issuers" ignored:"true"`
+
+	// Organizations is the allowlist of Buildkite organizations whose tokens are accepted.
+	// If empty, tokens of any organization are accepted.
+	Organizations []*ConfigOrganization `yaml:"organizations" ignored:"true"`
+
+	// PolicyPath optionally points to a YAML file with access rules evaluated before the built-in rules
+	PolicyPath string `yaml:"policyPath" envconfig:"POLICY_PATH" required:"false"`
+
+	// PermissionCeiling is the maximum access level per GitHub permission any token may be issued with.
+	// Defaults to DefaultPermissionCeiling.
+	PermissionCeiling api.Permissions `yaml:"permissionCeiling" ignored:"true"`
+
+	// Audit configures where audit events of token requests are written
+	Audit ConfigAudit `yaml:"audit" ignored:"true"`
+
+	// readProblems are the problems found by ReadConfig, reported by Validate
+	readProblems []ValidationProblem
 }
 
 // ConfigApplication is a single GitHub app configuration
@@ -35,11 +114,206 @@ type ConfigApplication struct {
 	// AppID is the github app's unique ID
 	AppID int64 `yaml:"appID"`
 
-	// PrivateKeyPath points to a file on disk where the private key is located
+	// PrivateKeyPath points to a file on disk where the private key is located. The file is read again when it
+	// changes, e.g. when a mounted Kubernetes secret is rotated.
 	PrivateKeyPath string `yaml:"privateKeyPath"`
 
+	// PrivateKey is the PEM encoded private key, as an alternative to PrivateKeyPath
+	PrivateKey string `yaml:"privateKey"`
+
+	// PrivateKeyEnv is the name of an environment variable holding the base64 or PEM encoded private key,
+	// as an alternative to PrivateKeyPath
+	PrivateKeyEnv string `yaml:"privateKeyEnv"`
+
+	// Signer signs app JWTs instead of a private key, e.g. with a key held by a KMS. It can only be set by
+	// programs embedding the server.
+	Signer crypto.Signer `yaml:"-"`
+
+	// APIURL is the REST API base URL. Defaults to https://api.github.com/ for github.com and
+	// https://<host>/api/v3/ for GitHub Enterprise Server.
+	APIURL string `yaml:"apiURL"`
+
+	// UploadURL is the upload API base URL. Defaults to https://uploads.github.com/ for github.com and
+	// https://<host>/api/uploads/ for GitHub Enterprise Server.
+	UploadURL string `yaml:"uploadURL"`
+
+	// CABundlePath optionally points to PEM encoded certificates trusted in addition to the system roots,
+	// e.g. the private CA of a GitHub Enterprise Server
+	CABundlePath string `yaml:"caBundlePath"`
+
+	// Proxy is the URL of the HTTP proxy used to reach the API. Defaults to HTTPS_PROXY and NO_PROXY from the environment.
+	Proxy string `yaml:"proxy"`
+
 	// Accounts is the list of app installations
 	Accounts []ConfigAccount `yaml:"accounts"`
+
+	// OrgGitOps optionally enables an org-wide policy file for repositories without a gitops.yaml
+	OrgGitOps *ConfigOrgGitOps `yaml:"orgGitOps"`
+
+	// GitOps configures where and how gitops files are read from repositories
+	GitOps ConfigGitOps `yaml:"gitops"`
+}
+
+// APIBaseURL returns the configured or default REST API base URL, always ending in a slash
+func (c *ConfigApplication) APIBaseURL() string {
+	if c.APIURL != "" {
+		return withTrailingSlash(c.APIURL)
+	}
+	if c.Host == "github.com" {
+		return "https://api.github.com/"
+	}
+	return fmt.Sprintf("https://%s/api/v3/", c.Host)
+}
+
+// UploadBaseURL returns the configured or default upload API base URL, always ending in a slash
+func (c *ConfigApplication) UploadBaseURL() string {
+	if c.UploadURL != "" {
+		return withTrailingSlash(c.UploadURL)
+	}
+	if c.Host == "github.com" {
+		return "https://uploads.github.com/"
+	}
+	return fmt.Sprintf("https://%s/api/uploads/", c.Host)
+}
+
+func withTrailingSlash(u string) string {
+	if strings.HasSuffix(u, "/") {
+		return u
+	}
+	return u + "/"
+}
+
+// Ref policies for reading gitops files
+const (
+	// GitOpsRefHead reads gitops files at HEAD
+	GitOpsRefHead = "HEAD"
+
+	// GitOpsRefDefaultBranch reads gitops files from the tip of the repository's default branch
+	GitOpsRefDefaultBranch = "default-branch"
+
+	// GitOpsRefProtected reads gitops files from the default branch and refuses them if the branch is not protected
+	GitOpsRefProtected = "protected"
+)
+
+// ConfigGitOps configures where and how gitops files are read from repositories
+type ConfigGitOps struct {
+	// Paths are tried in order, the first file found is used. Defaults to gitops.yaml.
+	Paths []string `yaml:"paths"`
+
+	// Ref is HEAD (default), default-branch, protected, or a literal branch, tag or commit
+	Ref string `yaml:"ref"`
+
+	// Format is yaml or json. By default files ending in .json are read as JSON, all others as YAML.
+	Format string `yaml:"format"`
+}
+
+// FilePaths returns the configured gitops file paths, or gitops.yaml if none are configured
+func (c ConfigGitOps) FilePaths() []string {
+	if len(c.Paths) == 0 {
+		return []string{"gitops.yaml"}
+	}
+	return c.Paths
+}
+
+// RefPolicy returns the configured ref policy, or HEAD if none is configured
+func (c ConfigGitOps) RefPolicy() string {
+	if c.Ref == "" {
+		return GitOpsRefHead
+	}
+	return c.Ref
+}
+
+// FileFormat returns the format a gitops file at a given path is read in
+func (c ConfigGitOps) FileFormat(path string) string {
+	if c.Format != "" {
+		return c.Format
+	}
+	if filepath.Ext(path) == ".json" {
+		return "json"
+	}
+	return "yaml"
+}
+
+// ConfigOrgGitOps locates the org-wide policy file consulted for repositories without a gitops.yaml
+type ConfigOrgGitOps struct {
+	// Org holds the policy file for all orgs on the host. Defaults to the org of the requested repository.
+	Org string `yaml:"org"`
+
+	// Repo is the repository holding the policy file, defaults to .github
+	Repo string `yaml:"repo"`
+
+	// Path is the policy file's path within Repo, defaults to gitops.yaml
+	Path string `yaml:"path"`
+}
+
+// Location returns the org, repo and path of the policy file applying to repositories of a given org
+func (c *ConfigOrgGitOps) Location(org string) (string, string, string) {
+	owner, repo, path := c.Org, c.Repo, c.Path
+	if owner == "" {
+		owner = org
+	}
+	if repo == "" {
+		repo = ".github"
+	}
+	if path == "" {
+		path = "gitops.yaml"
+	}
+	return owner, repo, path
+}
+
+// ConfigIssuer is a trusted OIDC token issuer
+type ConfigIssuer struct {
+	// Issuer must match the token's iss claim
+	Issuer string `yaml:"issuer"`
+
+	// JWKSURL is where the issuer's signing keys are published
+	JWKSURL string `yaml:"jwksURL"`
+
+	// Audiences are the accepted aud claims, defaults to Config.Audiences
+	Audiences []string `yaml:"audiences"`
+}
+
+// ConfigOrganization is a Buildkite organization permitted to request tokens
+type ConfigOrganization struct {
+	// Slug is the Buildkite organization slug
+	Slug string `yaml:"slug"`
+
+	// GitHub optionally limits which GitHub hosts and orgs the organization may access
+	GitHub []ConfigOrganizationGitHub `yaml:"github"`
+}
+
+// ConfigOrganizationGitHub lists the GitHub orgs on a host a Buildkite organization may access
+type ConfigOrganizationGitHub struct {
+	Host string `yaml:"host"`
+
+	// Orgs are GitHub org or account names, "*" permits all orgs on the host
+	Orgs []string `yaml:"orgs"`
+}
+
+// ConfigAudit configures the audit log
+type ConfigAudit struct {
+	Sinks []*ConfigAuditSink `yaml:"sinks"`
+}
+
+// ConfigAuditSink is a single destination for audit events
+type ConfigAuditSink struct {
+	// Type is one of file, stdout or http
+	Type string `yaml:"type"`
+
+	// Path is the JSONL file of file sinks
+	Path string `yaml:"path"`
+
+	// MaxSizeMB rotates file sinks once they exceed this size, 0 disables rotation
+	MaxSizeMB int64 `yaml:"maxSizeMB"`
+
+	// MaxBackups is how many rotated files are kept
+	MaxBackups int `yaml:"maxBackups"`
+
+	// URL is where http sinks post events to
+	URL string `yaml:"url"`
+
+	// Timeout limits how long http sinks wait for a response, defaults to 5s
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 // ConfigAccount refers to a single app installation
@@ -51,7 +325,46 @@ type ConfigAccount struct {
 	InstallationID int64 `yaml:"installationID"`
 }
 
+// NewConfig reads a config file and returns a *ValidationError listing every problem if it is invalid.
+// Files referenced by the config, such as private keys, are read when they are used, see Validate to check them upfront.
 func NewConfig(configPath string) (*Config, error) {
+	config, err := ReadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(false); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReloadConfig is NewConfig for a config file read again while serving. Fields which cannot be set in the file,
+// such as an application's Signer, are carried over from the application of the same host in previous.
+func ReloadConfig(configPath string, previous *Config) (*Config, error) {
+	config, err := ReadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range config.Applications {
+		if app.Signer != nil {
+			continue
+		}
+		for _, previousApp := range previous.Applications {
+			if previousApp.Host == app.Host {
+				app.Signer = previousApp.Signer
+				break
+			}
+		}
+	}
+	if err := config.validate(false); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReadConfig reads a config file without validating it. It only fails if the file cannot be read or is not YAML,
+// unknown keys and invalid values are reported by Validate.
+func ReadConfig(configPath string) (*Config, error) {
 	filename, _ := filepath.Abs(configPath)
 	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -59,19 +372,91 @@ func NewConfig(configPath string) (*Config, error) {
 	}
 
 	config := &Config{}
-	err = yaml.Unmarshal(yamlFile, config)
-	if err != nil {
+	// Unknown keys usually are typos, which would otherwise silently fall back to defaults
+	err = yaml.UnmarshalStrict(yamlFile, config)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, message := range typeErr.Errors {
+			config.readProblems = append(config.readProblems, ValidationProblem{Message: message})
+		}
+	} else if err != nil {
 		return nil, fmt.Errorf("unable to parse config file: %w", err)
 	}
 
 	err = envconfig.Process("", config)
 	if err != nil {
-		return nil, fmt.Errorf("unable to process environment config: %w", err)
+		config.readProblems = append(config.readProblems, ValidationProblem{Message: fmt.Sprintf("unable to process environment config: %s", err)})
 	}
 
 	return config, nil
 }
 
+// Ceiling returns the configured permission ceiling, or DefaultPermissionCeiling if none is set
+func (c *Config) Ceiling() api.Permissions {
+	if len(c.PermissionCeiling) == 0 {
+		return DefaultPermissionCeiling
+	}
+	return c.PermissionCeiling
+}
+
+// OIDCIssuers returns the trusted OIDC token issuers. If none are configured, tokens issued by the
+// Buildkite agent for any of Config.Audiences are accepted.
+func (c *Config) OIDCIssuers() []*ConfigIssuer {
+	if len(c.Issuers) == 0 {
+		return []*ConfigIssuer{
+			{
+				Issuer:    DefaultIssuer,
+				JWKSURL:   DefaultJWKSURL,
+				Audiences: c.Audiences,
+			},
+		}
+	}
+
+	issuers := make([]*ConfigIssuer, len(c.Issuers))
+	for idx, issuer := range c.Issuers {
+		issuers[idx] = issuer
+		if len(issuer.Audiences) == 0 {
+			withDefaults := *issuer
+			withDefaults.Audiences = c.Audiences
+			issuers[idx] = &withDefaults
+		}
+	}
+	return issuers
+}
+
+// OrganizationConfig returns the allowlist entry of a Buildkite organization. The second return value is
+// false if the organization is not permitted. If no allowlist is configured, every organization is permitted.
+func (c *Config) OrganizationConfig(slug string) (*ConfigOrganization, bool) {
+	if len(c.Organizations) == 0 {
+		return &ConfigOrganization{Slug: slug}, true
+	}
+	for _, org := range c.Organizations {
+		if org.Slug == slug {
+			return org, true
+		}
+	}
+	return nil, false
+}
+
+// GitHubOrgAllowed returns true if the Buildkite organization may access a GitHub org on a given host
+func (o *ConfigOrganization) GitHubOrgAllowed(host string, org string) bool {
+	if len(o.GitHub) == 0 {
+		return true
+	}
+	for _, gh := range o.GitHub {
+		if gh.Host != host {
+			continue
+		}
+		for _, allowed := range gh.Orgs {
+			// GitHub org logins are case-insensitive
+			if allowed == "*" || strings.EqualFold(allowed, org) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // AppConfigForHost returns the Application config for a given GitHub instance (github.com or GHES)
 func (c *Config) AppConfigForHost(host string) (*ConfigApplication, error) {
 	for _, hostConfig := range c.Applications {
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParsePrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key
+func ParsePrivateKey(contents []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("could not parse private key: no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("could not parse private key: expected an RSA key, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+// ParsePrivateKeyEnv parses the private key held by an environment variable, PEM encoded or base64 encoded PEM
+func ParsePrivateKeyEnv(name string) (crypto.Signer, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s with the private key is not set", name)
+	}
+	contents := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s is neither PEM nor base64 encoded: %w", name, err)
+		}
+		contents = decoded
+	}
+	return ParsePrivateKey(contents)
+}
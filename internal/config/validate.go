@@ -0,0 +1,222 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ValidationProblem is a single problem with a config
+type ValidationProblem struct {
+	// Field is the path of the offending setting, e.g. applications[0].appID. It is empty for problems
+	// reported by the YAML parser, whose message includes the line instead.
+	Field   string
+	Message string
+}
+
+func (p ValidationProblem) String() string {
+	if p.Field == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Field, p.Message)
+}
+
+// ValidationError lists every problem found in a config
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for idx, problem := range e.Problems {
+		messages[idx] = problem.String()
+	}
+	return fmt.Sprintf("invalid config: %s", strings.Join(messages, "; "))
+}
+
+// validator collects problems
+type validator struct {
+	problems []ValidationProblem
+}
+
+func (v *validator) add(field string, format string, args ...interface{}) {
+	v.problems = append(v.problems, ValidationProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// Validate returns a *ValidationError listing every problem with the config, including unknown keys and
+// invalid values found while reading it, and files referenced by the config which cannot be read.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate checks the config. Files referenced by the config are only checked if checkFiles is set.
+func (c *Config) validate(checkFiles bool) error {
+	v := &validator{}
+	v.problems = append(v.problems, c.readProblems...)
+
+	// checked here rather than by envconfig, which stops at the first missing variable
+	if c.BuildkiteToken == "" {
+		v.add("BUILDKITE_TOKEN", "must be set")
+	}
+	if c.ContextTimeout <= 0 {
+		v.add("DEFAULT_TIMEOUT", "must be positive, got %s", c.ContextTimeout)
+	}
+	for _, d := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"PIPELINE_CACHE_TTL", c.PipelineCacheTTL},
+		{"GITOPS_CACHE_TTL", c.GitOpsCacheTTL},
+		{"GITOPS_NOT_FOUND_TTL", c.GitOpsNotFoundTTL},
+		{"CONFIG_WATCH_INTERVAL", c.ConfigWatchInterval},
+		{"SHUTDOWN_DELAY", c.ShutdownDelay},
+		{"SHUTDOWN_DRAIN_TIMEOUT", c.ShutdownDrainTimeout},
+	} {
+		if d.value < 0 {
+			v.add(d.field, "must not be negative, got %s", d.value)
+		}
+	}
+
+	if err := c.PermissionCeiling.Validate(); err != nil {
+		v.add("permissionCeiling", "%s", err)
+	}
+
+	hosts := make(map[string]int)
+	for idx, app := range c.Applications {
+		validateApplication(v, fmt.Sprintf("applications[%d]", idx), app, checkFiles)
+		if first, ok := hosts[app.Host]; ok && app.Host != "" {
+			v.add(fmt.Sprintf("applications[%d].host", idx), "duplicate host %s, already configured by applications[%d]", app.Host, first)
+		} else {
+			hosts[app.Host] = idx
+		}
+	}
+
+	for idx, sink := range c.Audit.Sinks {
+		field := fmt.Sprintf("audit.sinks[%d]", idx)
+		switch sink.Type {
+		case "file":
+			if sink.Path == "" {
+				v.add(field+".path", "must be set for sinks of type file")
+			}
+		case "http":
+			if sink.URL == "" {
+				v.add(field+".url", "must be set for sinks of type http")
+			}
+		case "stdout":
+		default:
+			v.add(field+".type", "unknown audit sink type '%s', must be file, http or stdout", sink.Type)
+		}
+		if sink.Timeout < 0 {
+			v.add(field+".timeout", "must not be negative, got %s", sink.Timeout)
+		}
+	}
+
+	issuers := make(map[string]int)
+	for idx, issuer := range c.OIDCIssuers() {
+		field := fmt.Sprintf("issuers[%d]", idx)
+		if issuer.Issuer == "" {
+			v.add(field+".issuer", "must be set")
+		} else if first, ok := issuers[issuer.Issuer]; ok {
+			v.add(field+".issuer", "duplicate issuer %s, already configured by issuers[%d]", issuer.Issuer, first)
+		} else {
+			issuers[issuer.Issuer] = idx
+		}
+		if issuer.JWKSURL == "" {
+			v.add(field+".jwksURL", "must be set")
+		}
+		if len(issuer.Audiences) == 0 {
+			v.add(field+".audiences", "no accepted audiences configured for issuer %s", issuer.Issuer)
+		}
+	}
+
+	slugs := make(map[string]bool)
+	for idx, org := range c.Organizations {
+		field := fmt.Sprintf("organizations[%d].slug", idx)
+		if org.Slug == "" {
+			v.add(field, "must be set")
+		} else if slugs[org.Slug] {
+			v.add(field, "duplicate organization %s", org.Slug)
+		}
+		slugs[org.Slug] = true
+	}
+
+	if checkFiles && c.PolicyPath != "" {
+		if _, err := os.Stat(c.PolicyPath); err != nil {
+			v.add("policyPath", "cannot read policy file: %s", err)
+		}
+	}
+
+	return v.err()
+}
+
+func validateApplication(v *validator, field string, app *ConfigApplication, checkFiles bool) {
+	if app.Host == "" {
+		v.add(field+".host", "must be set")
+	}
+	if app.AppID <= 0 {
+		v.add(field+".appID", "must be set")
+	}
+
+	keySources := 0
+	for _, source := range []string{app.PrivateKeyPath, app.PrivateKey, app.PrivateKeyEnv} {
+		if source != "" {
+			keySources++
+		}
+	}
+	switch {
+	case keySources > 1:
+		v.add(field, "only one of privateKeyPath, privateKey and privateKeyEnv may be set")
+	case keySources == 0 && app.Signer == nil:
+		v.add(field, "one of privateKeyPath, privateKey and privateKeyEnv must be set")
+	case app.PrivateKey != "":
+		if _, err := ParsePrivateKey([]byte(app.PrivateKey)); err != nil {
+			v.add(field+".privateKey", "%s", err)
+		}
+	case app.PrivateKeyEnv != "" && checkFiles:
+		if _, err := ParsePrivateKeyEnv(app.PrivateKeyEnv); err != nil {
+			v.add(field+".privateKeyEnv", "%s", err)
+		}
+	case app.PrivateKeyPath != "" && checkFiles:
+		if contents, err := ioutil.ReadFile(app.PrivateKeyPath); err != nil {
+			v.add(field+".privateKeyPath", "cannot read private key: %s", err)
+		} else if _, err := ParsePrivateKey(contents); err != nil {
+			v.add(field+".privateKeyPath", "%s in %s", err, app.PrivateKeyPath)
+		}
+	}
+
+	if checkFiles && app.CABundlePath != "" {
+		if _, err := ioutil.ReadFile(app.CABundlePath); err != nil {
+			v.add(field+".caBundlePath", "cannot read ca bundle: %s", err)
+		}
+	}
+
+	for _, u := range []struct {
+		name  string
+		value string
+	}{
+		{"apiURL", app.APIURL},
+		{"uploadURL", app.UploadURL},
+		{"proxy", app.Proxy},
+	} {
+		if u.value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.value); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			v.add(field+"."+u.name, "invalid url '%s', must be absolute", u.value)
+		}
+	}
+
+	if format := app.GitOps.Format; format != "" && format != "yaml" && format != "json" {
+		v.add(field+".gitops.format", "invalid format '%s', must be yaml or json", format)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
-	"os"
 	"strings"
 )
 
@@ -73,12 +71,16 @@ func SendOutput(resp GitCredentialResponse, to io.Writer) {
 	to.Write([]byte(output.String()))
 }
 
-// GetCredentialAction returns the credential action requested by git-credentials. It is always the last argument passed to the program
+// GetCredentialAction returns the credential action requested by git-credentials, given the program's arguments
+// (usually os.Args). It is always the last argument passed to the program
 // see: https://git-scm.com/docs/gitcredentials#_custom_helpers
-func GetCredentialAction() string {
-	action := os.Args[len(os.Args)-1]
+func GetCredentialAction(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("no git-credential action given")
+	}
+	action := args[len(args)-1]
 	if action != "get" && action != "store" && action != "erase" {
-		log.Fatalf("unable to process git-credential action '%s'", action)
+		return "", fmt.Errorf("unable to process git-credential action '%s'", action)
 	}
-	return action
+	return action, nil
 }
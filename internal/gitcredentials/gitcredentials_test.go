@@ -79,3 +79,29 @@ func TestSendOutput(t *testing.T) {
 		})
 	}
 }
+
+func TestGetCredentialAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "get", args: []string{"git-credential-buildkite-oidc", "get"}, want: "get"},
+		{name: "lastArgument", args: []string{"git-credential-buildkite-oidc", "--flag", "erase"}, want: "erase"},
+		{name: "unknown", args: []string{"git-credential-buildkite-oidc", "fetch"}, wantErr: true},
+		{name: "noArguments", args: []string{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetCredentialAction(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetCredentialAction() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("GetCredentialAction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
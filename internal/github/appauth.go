@@ -0,0 +1,142 @@
+package github
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// keySource provides the key app JWTs are signed with
+type keySource interface {
+	Signer() (crypto.Signer, error)
+}
+
+// staticKey is a key which never changes, e.g. an inline PEM or an external signer
+type staticKey struct {
+	signer crypto.Signer
+}
+
+func (k staticKey) Signer() (crypto.Signer, error) {
+	return k.signer, nil
+}
+
+// fileKey is a PEM encoded key on disk, which is read again whenever the file changes
+type fileKey struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	signer  crypto.Signer
+}
+
+func (k *fileKey) Signer() (crypto.Signer, error) {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.signer != nil && info.ModTime().Equal(k.modTime) && info.Size() == k.size {
+		return k.signer, nil
+	}
+
+	contents, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key: %w", err)
+	}
+	signer, err := config.ParsePrivateKey(contents)
+	if err != nil {
+		return nil, err
+	}
+	k.signer, k.modTime, k.size = signer, info.ModTime(), info.Size()
+	return k.signer, nil
+}
+
+// newKeySource returns the key source configured for an app
+func newKeySource(app *config.ConfigApplication) (keySource, error) {
+	switch {
+	case app.Signer != nil:
+		if _, ok := app.Signer.Public().(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("signer must use an RSA key, got %T", app.Signer.Public())
+		}
+		return staticKey{signer: app.Signer}, nil
+	case app.PrivateKey != "":
+		signer, err := config.ParsePrivateKey([]byte(app.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		return staticKey{signer: signer}, nil
+	case app.PrivateKeyEnv != "":
+		signer, err := config.ParsePrivateKeyEnv(app.PrivateKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		return staticKey{signer: signer}, nil
+	case app.PrivateKeyPath != "":
+		key := &fileKey{path: app.PrivateKeyPath}
+		// fail early on a missing or broken key
+		if _, err := key.Signer(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("no private key configured")
+	}
+}
+
+// appsTransport authenticates requests as a GitHub App, with a JWT signed by the configured key
+type appsTransport struct {
+	tr    http.RoundTripper
+	appID int64
+	key   keySource
+}
+
+func (t *appsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed, err := t.signJWT()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+signed)
+	req.Header.Add("Accept", "application/vnd.github.v3+json")
+	return t.tr.RoundTrip(req)
+}
+
+// signJWT returns a short-lived app JWT. GitHub rejects tokens valid for more than 10 minutes, and
+// tokens issued in the future due to clock drift.
+func (t *appsTransport) signJWT() (string, error) {
+	signer, err := t.key.Signer()
+	if err != nil {
+		return "", err
+	}
+
+	issuedAt := time.Now().Add(-30 * time.Second).Truncate(time.Second)
+	token, err := jwt.NewBuilder().
+		Issuer(strconv.FormatInt(t.appID, 10)).
+		IssuedAt(issuedAt).
+		Expiration(issuedAt.Add(2 * time.Minute)).
+		Build()
+	if err != nil {
+		return "", err
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, signer))
+	if err != nil {
+		return "", fmt.Errorf("could not sign app jwt: %w", err)
+	}
+	return string(signed), nil
+}
@@ -0,0 +1,113 @@
+package github
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+func newTestKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestNewKeySource(t *testing.T) {
+	key, pemKey := newTestKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Setenv("TEST_APP_KEY_BASE64", base64.StdEncoding.EncodeToString(pemKey))
+	t.Setenv("TEST_APP_KEY_PEM", string(pemKey))
+	t.Setenv("TEST_APP_KEY_INVALID", "not a key")
+
+	tests := []struct {
+		name    string
+		app     config.ConfigApplication
+		wantErr bool
+	}{
+		{name: "inline", app: config.ConfigApplication{PrivateKey: string(pemKey)}},
+		{name: "inlinePKCS8", app: config.ConfigApplication{PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))}},
+		{name: "envBase64", app: config.ConfigApplication{PrivateKeyEnv: "TEST_APP_KEY_BASE64"}},
+		{name: "envPEM", app: config.ConfigApplication{PrivateKeyEnv: "TEST_APP_KEY_PEM"}},
+		{name: "file", app: config.ConfigApplication{PrivateKeyPath: writeTestFile(t, "app.pem", pemKey)}},
+		{name: "signer", app: config.ConfigApplication{Signer: key}},
+		{name: "envInvalid", app: config.ConfigApplication{PrivateKeyEnv: "TEST_APP_KEY_INVALID"}, wantErr: true},
+		{name: "envMissing", app: config.ConfigApplication{PrivateKeyEnv: "TEST_APP_KEY_MISSING"}, wantErr: true},
+		{name: "fileMissing", app: config.ConfigApplication{PrivateKeyPath: "doesnotexist.pem"}, wantErr: true},
+		{name: "nonRSASigner", app: config.ConfigApplication{Signer: ecKey}, wantErr: true},
+		{name: "none", app: config.ConfigApplication{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := newKeySource(&tt.app)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			signer, err := source.Signer()
+			require.NoError(t, err)
+			assert.True(t, key.PublicKey.Equal(signer.Public()))
+		})
+	}
+}
+
+func TestFileKeyReload(t *testing.T) {
+	first, firstPEM := newTestKey(t)
+	second, secondPEM := newTestKey(t)
+	path := writeTestFile(t, "app.pem", firstPEM)
+
+	source, err := newKeySource(&config.ConfigApplication{PrivateKeyPath: path})
+	require.NoError(t, err)
+	signer, err := source.Signer()
+	require.NoError(t, err)
+	assert.True(t, first.PublicKey.Equal(signer.Public()))
+
+	require.NoError(t, os.WriteFile(path, secondPEM, 0600))
+	// make sure the change is visible even on file systems with coarse modification times
+	require.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	signer, err = source.Signer()
+	require.NoError(t, err)
+	assert.True(t, second.PublicKey.Equal(signer.Public()))
+}
+
+func TestAppsTransport(t *testing.T) {
+	key, _ := newTestKey(t)
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &appsTransport{tr: http.DefaultTransport, appID: 1234, key: staticKey{signer: key}}}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.True(t, strings.HasPrefix(authorization, "Bearer "))
+	token, err := jwt.Parse([]byte(strings.TrimPrefix(authorization, "Bearer ")), jwt.WithKey(jwa.RS256, &key.PublicKey))
+	require.NoError(t, err)
+	assert.Equal(t, "1234", token.Issuer())
+	assert.LessOrEqual(t, token.Expiration().Sub(token.IssuedAt()), 10*time.Minute)
+}
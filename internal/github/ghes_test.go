@@ -0,0 +1,122 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+// newGHESServer returns a TLS test server answering like a GitHub Enterprise Server API at /api/v3/
+func newGHESServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		switch {
+		case r.URL.Path == "/api/v3/app/installations" && strings.HasPrefix(auth, "Bearer ey"):
+			fmt.Fprint(w, `[{"id": 1, "account": {"login": "myorg"}}]`)
+		case r.URL.Path == "/api/v3/orgs/myorg/installation" && strings.HasPrefix(auth, "Bearer ey"):
+			fmt.Fprint(w, `{"id": 1}`)
+		case r.URL.Path == "/api/v3/app/installations/1/access_tokens" && strings.HasPrefix(auth, "Bearer ey"):
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "ghs_installation", "expires_at": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		case r.URL.Path == "/api/v3/repos/myorg/x/contents/gitops.yaml" && auth == "Bearer ghs_installation":
+			fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`,
+				base64.StdEncoding.EncodeToString([]byte("repos:\n  - github.com/myorg/deployer\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeTestFile writes contents to a file in a temporary directory and returns its path
+func writeTestFile(t *testing.T, name string, contents []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, contents, 0600))
+	return path
+}
+
+func TestNewClientForHostEnterprise(t *testing.T) {
+	srv := newGHESServer(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := writeTestFile(t, "app.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	caPath := writeTestFile(t, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	newConfig := func(caBundlePath string) *config.Config {
+		return &config.Config{
+			Applications: []*config.ConfigApplication{
+				{
+					Host:           "ghes.example.com",
+					AppID:          1234,
+					PrivateKeyPath: keyPath,
+					APIURL:         srv.URL + "/api/v3",
+					CABundlePath:   caBundlePath,
+				},
+			},
+		}
+	}
+
+	t.Run("untrustedCertificate", func(t *testing.T) {
+		_, err := NewClientForHost(newConfig(""), "ghes.example.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("caBundle", func(t *testing.T) {
+		client, err := NewClientForHost(newConfig(caPath), "ghes.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, srv.URL+"/api/v3/", client.Client.BaseURL.String())
+		require.Len(t, client.Config.Accounts, 1)
+		assert.Equal(t, "myorg", client.Config.Accounts[0].Name)
+
+		gitops, err := client.GetGitOps("myorg", "x")
+		require.NoError(t, err)
+		require.NotNil(t, gitops)
+		assert.Len(t, gitops.Repositories, 1)
+
+		token, err := client.CreateInstallationToken([]repoparser.RepositoryName{{Host: "ghes.example.com", Org: "myorg", Repo: "x"}}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "ghs_installation", token.GetToken())
+	})
+
+	t.Run("unknownHost", func(t *testing.T) {
+		_, err := NewClientForHost(newConfig(caPath), "github.com")
+		assert.ErrorContains(t, err, "no github app config found")
+	})
+
+	t.Run("invalidCABundle", func(t *testing.T) {
+		_, err := NewClientForHost(newConfig(keyPath), "ghes.example.com")
+		assert.ErrorContains(t, err, "no certificates found")
+	})
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	transport, err := newTransport(&config.ConfigApplication{Host: "ghes.example.com", Proxy: "http://proxy.example.com:3128"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://ghes.example.com/api/v3/", nil)
+	require.NoError(t, err)
+	proxyURL, err := transport.Proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://proxy.example.com:3128", proxyURL.String())
+}
@@ -3,11 +3,8 @@ package github
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"time"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v48/github"
 	"golang.org/x/oauth2"
 
@@ -16,38 +13,46 @@ import (
 )
 
 type Client struct {
-	Client     *github.Client
-	OrgClients map[string]*OrgClient
-	Config     *config.ConfigApplication
-}
+	Client *github.Client
+	Config *config.ConfigApplication
+
+	// transport carries all requests to the host, trusting its CA bundle and using its proxy
+	transport http.RoundTripper
+
+	// orgClients caches read-only clients per org, see ClientForOrg
+	orgClients orgClientCache
 
-type OrgClient struct {
-	ExpiresAt      time.Time
-	Client         *github.Client
-	InstallationID int64
+	// gitOps optionally caches parsed gitops.yaml files
+	gitOps *gitOpsCache
 }
 
-// NewClientForHost ...
+// NewClientForHost returns a client authenticated as the GitHub app configured for a host, and adds the
+// app's installations to its config
 func NewClientForHost(cfg *config.Config, host string) (*Client, error) {
 	githubAppHostConfig, err := cfg.AppConfigForHost(host)
 	if err != nil {
-		log.Fatalf("no github app config found for host %s: %s", host, err.Error())
+		return nil, fmt.Errorf("no github app config found for host %s: %w", host, err)
+	}
+	transport, err := newTransport(githubAppHostConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize transport: %w", err)
 	}
 	client := &Client{
-		Config:     githubAppHostConfig,
-		OrgClients: make(map[string]*OrgClient),
+		Config:    githubAppHostConfig,
+		transport: transport,
 	}
-	itr, err := ghinstallation.NewAppsTransportKeyFromFile(http.DefaultTransport, githubAppHostConfig.AppID, githubAppHostConfig.PrivateKeyPath)
+	key, err := newKeySource(githubAppHostConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize apps transport: %v", err)
 	}
+	itr := &appsTransport{tr: transport, appID: githubAppHostConfig.AppID, key: key}
 
-	if host == "github.com" {
+	if host == "github.com" && githubAppHostConfig.APIURL == "" {
 		// Auth to GitHub.com
 		client.Client = github.NewClient(&http.Client{Transport: itr})
 	} else {
-		// Auth to GitHub Enterprise Server
-		client.Client, err = github.NewEnterpriseClient(host, host, &http.Client{Transport: itr})
+		// Auth to GitHub Enterprise Server, whose API is served at /api/v3/ by default
+		client.Client, err = github.NewEnterpriseClient(githubAppHostConfig.APIBaseURL(), githubAppHostConfig.UploadBaseURL(), &http.Client{Transport: itr})
 		if err != nil {
 			return nil, err
 		}
@@ -68,25 +73,6 @@ func NewClientForHost(cfg *config.Config, host string) (*Client, error) {
 	return client, nil
 }
 
-func (c *Client) GetContents(owner string, repo string, path string) (contents string, status int, err error) {
-	orgClient, _, err := c.ClientForOrg(owner)
-	if err != nil {
-		return "", 0, fmt.Errorf("cannot get github client for org %s: %w", owner, err)
-	}
-	fileContent, _, resp, err := orgClient.Repositories.GetContents(context.TODO(), owner, repo, path, &github.RepositoryContentGetOptions{
-		Ref: "HEAD",
-	})
-
-	if err != nil {
-		if resp != nil {
-			return "", resp.StatusCode, err
-		}
-		return "", 0, err
-	}
-	contents, err = fileContent.GetContent()
-	return contents, 0, err
-}
-
 func (c *Client) CreateInstallationToken(repos []repoparser.RepositoryName, permissions *github.InstallationPermissions) (*github.InstallationToken, error) {
 	if len(repos) == 0 {
 		return nil, fmt.Errorf("must supply at least one repository")
@@ -120,51 +106,32 @@ func (c *Client) CreateInstallationToken(repos []repoparser.RepositoryName, perm
 	return token, err
 }
 
-// ClientForOrg returns a GitHub client with read access to contents and metadata for a given org
-func (c *Client) ClientForOrg(org string) (*github.Client, int64, error) {
-	var installationID int64
-	// Check in-memory cache
-	if val, ok := c.OrgClients[org]; ok {
-		// Found a client in the cache
-		if !val.ExpiresAt.Before(time.Now().Add(-time.Second * 30)) {
-			// Got more than 30 seconds left on that token/client
-			return val.Client, val.InstallationID, nil
-		}
-		// Despite the client being expired, keep the cached installation ID to save us one API call to github
-		installationID = val.InstallationID
-
-		// TODO invalidate cache, multi threading? I think I shouldn't do that
-		delete(c.OrgClients, org)
-	}
-
-	if installationID == 0 {
-		installation, _, err := c.Client.Apps.FindOrganizationInstallation(context.TODO(), org)
-		if err != nil {
-			return nil, 0, fmt.Errorf("cannot find github app installation for organization %s: %w", org, err)
+// RevokeInstallationToken revokes an installation token issued by CreateInstallationToken. Tokens which
+// GitHub no longer accepts (e.g. already expired or revoked) are treated as revoked.
+func (c *Client) RevokeInstallationToken(token string) error {
+	resp, err := c.tokenClient(token).Apps.RevokeInstallationToken(context.TODO())
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil
 		}
-		installationID = *installation.ID
+		return fmt.Errorf("cannot revoke installation token: %w", err)
 	}
+	return nil
+}
 
-	// Create new static token so we can access org contents, do not limit to repos
-	token, _, err := c.Client.Apps.CreateInstallationToken(context.TODO(), installationID, &github.InstallationTokenOptions{
-		Permissions: &github.InstallationPermissions{
-			Contents: github.String("read"),
-			Metadata: github.String("read"),
-		},
-	})
-	if err != nil {
-		return nil, 0, err
+// tokenClient returns a client authenticated with an installation token, talking to the same API as the
+// app client through the same transport, which matters for GitHub Enterprise Server
+func (c *Client) tokenClient(token string) *github.Client {
+	ctx := context.TODO()
+	if c.transport != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: c.transport})
 	}
-
 	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: *token.Token},
+		&oauth2.Token{AccessToken: token},
 	)
 
-	oauthCli := oauth2.NewClient(context.TODO(), ts)
-
-	c.OrgClients[org] = &OrgClient{
-		Client:    github.NewClient(oauthCli),
-		ExpiresAt: *token.ExpiresAt,
-	}
-	return c.OrgClients[org].Client, installationID, nil
+	client := github.NewClient(oauth2.NewClient(ctx, ts))
+	client.BaseURL = c.Client.BaseURL
+	client.UploadURL = c.Client.UploadURL
+	return client
 }
@@ -0,0 +1,46 @@
+package github
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v48/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGitHubClient returns a go-github client which sends all requests to the given test server
+func newTestGitHubClient(t *testing.T, srv *httptest.Server) *github.Client {
+	t.Helper()
+	client := github.NewClient(srv.Client())
+	baseURL, err := url.Parse(srv.URL + "/")
+	require.NoError(t, err)
+	client.BaseURL = baseURL
+	return client
+}
+
+func TestRevokeInstallationToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/installation/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer valid":
+			w.WriteHeader(http.StatusNoContent)
+		case "Bearer expired":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{Client: newTestGitHubClient(t, srv)}
+
+	assert.NoError(t, c.RevokeInstallationToken("valid"))
+	assert.NoError(t, c.RevokeInstallationToken("expired"))
+	assert.Error(t, c.RevokeInstallationToken("broken"))
+}
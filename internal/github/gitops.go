@@ -0,0 +1,272 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/go-github/v48/github"
+
+	"github.com/moensch/buildkite-github-token-server/internal/cache"
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/metrics"
+)
+
+// cachedGitOps is a cached gitops.yaml or org policy file lookup. GitOps or OrgGitOps is nil if the file does not exist.
+type cachedGitOps struct {
+	GitOps    *GitOps
+	OrgGitOps *OrgGitOps
+	ETag      string
+}
+
+// cachedRef is a cached resolution of the gitops ref policy for a repository
+type cachedRef struct {
+	Ref string
+
+	// Unprotected is set if the policy refuses to read from the repository's default branch, Branch
+	Unprotected bool
+	Branch      string
+}
+
+// UnprotectedBranchError is returned when gitops files may only be read from protected default branches, and the
+// default branch of a repository is not protected
+type UnprotectedBranchError struct {
+	Owner  string
+	Repo   string
+	Branch string
+}
+
+func (e *UnprotectedBranchError) Error() string {
+	return fmt.Sprintf("default branch %s of %s/%s is not protected, refusing to read its gitops files", e.Branch, e.Owner, e.Repo)
+}
+
+// gitOpsCache holds parsed gitops.yaml files and the refs they are read from, and how long to cache them for
+type gitOpsCache struct {
+	entries     *cache.Cache[string, cachedGitOps]
+	refs        *cache.Cache[string, cachedRef]
+	ttl         time.Duration
+	notFoundTTL time.Duration
+}
+
+// WithGitOpsCache enables caching of parsed gitops.yaml files for ttl, revalidating them with conditional
+// requests once expired. Repositories without a gitops.yaml are cached for notFoundTTL. The default branches
+// gitops files are read from, see config.ConfigGitOps.Ref, are cached for ttl as well.
+func (c *Client) WithGitOpsCache(ttl time.Duration, notFoundTTL time.Duration, size int) *Client {
+	c.gitOps = &gitOpsCache{
+		entries:     cache.New[string, cachedGitOps]("github_gitops", ttl, size),
+		refs:        cache.New[string, cachedRef]("github_gitops_ref", ttl, size),
+		ttl:         ttl,
+		notFoundTTL: notFoundTTL,
+	}
+	return c
+}
+
+// GetGitOps returns the parsed gitops file of a repository, or nil if the repository does not have one.
+// The configured paths are tried in order. If the ref policy refuses to read from the repository, the error
+// is an *UnprotectedBranchError.
+func (c *Client) GetGitOps(owner string, repo string) (*GitOps, error) {
+	ref, err := c.gitOpsRef(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.gitOpsConfig()
+	for _, path := range cfg.FilePaths() {
+		format := cfg.FileFormat(path)
+		cached, err := c.loadGitOps("repo", owner, repo, path, ref, func(contents string) (cachedGitOps, error) {
+			var gitops GitOps
+			var err error
+			if format == "json" {
+				gitops, err = GitOpsFromJSON(contents)
+			} else {
+				gitops, err = GitOpsFromString(contents)
+			}
+			gitops.Source = path
+			return cachedGitOps{GitOps: &gitops}, err
+		})
+		if err != nil || cached.GitOps != nil {
+			return cached.GitOps, err
+		}
+	}
+	return nil, nil
+}
+
+// GetOrgGitOps returns the parsed org-wide policy file applying to repositories of an org, or nil if
+// none is configured for the host or the file does not exist. Like GetGitOps, it returns an
+// *UnprotectedBranchError if the ref policy refuses to read from the repository holding the file.
+func (c *Client) GetOrgGitOps(org string) (*OrgGitOps, error) {
+	if c.Config == nil || c.Config.OrgGitOps == nil {
+		return nil, nil
+	}
+	owner, repo, path := c.Config.OrgGitOps.Location(org)
+	ref, err := c.gitOpsRef(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	format := c.gitOpsConfig().FileFormat(path)
+	cached, err := c.loadGitOps("org", owner, repo, path, ref, func(contents string) (cachedGitOps, error) {
+		var orgGitOps OrgGitOps
+		var err error
+		if format == "json" {
+			orgGitOps, err = OrgGitOpsFromJSON(contents)
+		} else {
+			orgGitOps, err = OrgGitOpsFromString(contents)
+		}
+		orgGitOps.Source = fmt.Sprintf("%s/%s/%s", owner, repo, path)
+		return cachedGitOps{OrgGitOps: &orgGitOps}, err
+	})
+	return cached.OrgGitOps, err
+}
+
+// loadGitOps returns a parsed policy file, through the cache if enabled. kind tells repository gitops files
+// and org policy files apart, as the org policy file may also be a path of the repository it lives in.
+func (c *Client) loadGitOps(kind string, owner string, repo string, path string, ref string, parse func(contents string) (cachedGitOps, error)) (cachedGitOps, error) {
+	if c.gitOps == nil {
+		cached, _, err := c.fetchGitOps(owner, repo, path, ref, nil, parse)
+		return cached, err
+	}
+
+	key := fmt.Sprintf("%s:%s/%s/%s/%s", kind, c.Config.Host, owner, repo, path)
+	return c.gitOps.entries.Load(key, func(stale *cachedGitOps) (cachedGitOps, time.Duration, error) {
+		return c.fetchGitOps(owner, repo, path, ref, stale, parse)
+	})
+}
+
+// fetchGitOps fetches and parses a policy file at ref. If a stale copy with an ETag is given, the file is only
+// downloaded again if it changed. Conditional requests answered with 304 do not count against the rate limit.
+func (c *Client) fetchGitOps(owner string, repo string, path string, ref string, stale *cachedGitOps, parse func(contents string) (cachedGitOps, error)) (cachedGitOps, time.Duration, error) {
+	var etag string
+	if stale != nil {
+		etag = stale.ETag
+	}
+
+	contents, newETag, status, err := c.GetContentsConditional(owner, repo, path, ref, etag)
+	if err != nil {
+		if status == http.StatusNotFound {
+			metrics.PromMetrics.GitHubConditionalRequests.WithLabelValues("not_found").Inc()
+			return cachedGitOps{}, c.notFoundTTL(), nil
+		}
+		return cachedGitOps{}, 0, err
+	}
+	if status == http.StatusNotModified {
+		metrics.PromMetrics.GitHubConditionalRequests.WithLabelValues("not_modified").Inc()
+		return *stale, c.gitOpsTTL(), nil
+	}
+	metrics.PromMetrics.GitHubConditionalRequests.WithLabelValues("modified").Inc()
+
+	parsed, err := parse(contents)
+	if err != nil {
+		return cachedGitOps{}, 0, fmt.Errorf("cannot parse %s in %s/%s: %s", path, owner, repo, err)
+	}
+	parsed.ETag = newETag
+	return parsed, c.gitOpsTTL(), nil
+}
+
+// gitOpsConfig returns how gitops files are read on this host
+func (c *Client) gitOpsConfig() config.ConfigGitOps {
+	if c.Config == nil {
+		return config.ConfigGitOps{}
+	}
+	return c.Config.GitOps
+}
+
+// gitOpsRef resolves the configured ref policy to the ref gitops files of a repository are read from, through
+// the cache if enabled
+func (c *Client) gitOpsRef(owner string, repo string) (string, error) {
+	policy := c.gitOpsConfig().RefPolicy()
+	if policy != config.GitOpsRefDefaultBranch && policy != config.GitOpsRefProtected {
+		// HEAD or a literal ref
+		return policy, nil
+	}
+
+	var resolved cachedRef
+	var err error
+	if c.gitOps == nil {
+		resolved, err = c.resolveDefaultBranch(owner, repo, policy)
+	} else {
+		key := fmt.Sprintf("%s/%s/%s", c.Config.Host, owner, repo)
+		resolved, err = c.gitOps.refs.Get(key, func() (cachedRef, error) {
+			return c.resolveDefaultBranch(owner, repo, policy)
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	if resolved.Unprotected {
+		return "", &UnprotectedBranchError{Owner: owner, Repo: repo, Branch: resolved.Branch}
+	}
+	return resolved.Ref, nil
+}
+
+// resolveDefaultBranch looks up the default branch of a repository, and with the protected ref policy whether
+// it is protected
+func (c *Client) resolveDefaultBranch(owner string, repo string, policy string) (cachedRef, error) {
+	orgClient, _, err := c.ClientForOrg(owner)
+	if err != nil {
+		return cachedRef{}, fmt.Errorf("cannot get github client for org %s: %w", owner, err)
+	}
+	repository, _, err := orgClient.Repositories.Get(context.TODO(), owner, repo)
+	if err != nil {
+		return cachedRef{}, fmt.Errorf("cannot get default branch of %s/%s: %w", owner, repo, err)
+	}
+	branch := repository.GetDefaultBranch()
+	if policy == config.GitOpsRefProtected {
+		b, _, err := orgClient.Repositories.GetBranch(context.TODO(), owner, repo, branch, false)
+		if err != nil {
+			return cachedRef{}, fmt.Errorf("cannot get branch %s of %s/%s: %w", branch, owner, repo, err)
+		}
+		if !b.GetProtected() {
+			return cachedRef{Unprotected: true, Branch: branch}, nil
+		}
+	}
+	return cachedRef{Ref: fmt.Sprintf("refs/heads/%s", branch), Branch: branch}, nil
+}
+
+func (c *Client) gitOpsTTL() time.Duration {
+	if c.gitOps == nil {
+		return 0
+	}
+	return c.gitOps.ttl
+}
+
+func (c *Client) notFoundTTL() time.Duration {
+	if c.gitOps == nil {
+		return 0
+	}
+	return c.gitOps.notFoundTTL
+}
+
+// GetContentsConditional reads a file at a given ref, sending If-None-Match if an ETag is given. If the file did not
+// change, it returns http.StatusNotModified and no error. On other errors, status is the HTTP status code if known.
+func (c *Client) GetContentsConditional(owner string, repo string, path string, ref string, etag string) (contents string, newETag string, status int, err error) {
+	orgClient, _, err := c.ClientForOrg(owner)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("cannot get github client for org %s: %w", owner, err)
+	}
+
+	escapedPath := (&url.URL{Path: path}).String()
+	query := url.Values{"ref": {ref}}
+	req, err := orgClient.NewRequest(http.MethodGet, fmt.Sprintf("repos/%s/%s/contents/%s?%s", owner, repo, escapedPath, query.Encode()), nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	fileContent := &github.RepositoryContent{}
+	resp, err := orgClient.Do(context.TODO(), req, fileContent)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return "", etag, http.StatusNotModified, nil
+	}
+	if err != nil {
+		if resp != nil {
+			return "", "", resp.StatusCode, err
+		}
+		return "", "", 0, err
+	}
+
+	contents, err = fileContent.GetContent()
+	return contents, resp.Header.Get("ETag"), resp.StatusCode, err
+}
@@ -0,0 +1,237 @@
+package github
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+// newTestClient returns a Client whose org client for "myorg" talks to the given test server
+func newTestClient(t *testing.T, srv *httptest.Server) *Client {
+	t.Helper()
+	return &Client{
+		Config: &config.ConfigApplication{Host: "github.com"},
+		orgClients: orgClientCache{
+			clients: map[string]*OrgClient{
+				"myorg": {
+					Client:    newTestGitHubClient(t, srv),
+					ExpiresAt: time.Now().Add(time.Hour),
+				},
+			},
+		},
+	}
+}
+
+func TestGetGitOpsCache(t *testing.T) {
+	var requests, notModified int32
+	const etag = `"abc123"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/repos/myorg/withgitops/contents/gitops.yaml":
+			if r.Header.Get("If-None-Match") == etag {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`,
+				base64.StdEncoding.EncodeToString([]byte("repos:\n  - github.com/myorg/deployer\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t, srv).WithGitOpsCache(50*time.Millisecond, 50*time.Millisecond, 10)
+
+	t.Run("cached", func(t *testing.T) {
+		gitops, err := client.GetGitOps("myorg", "withgitops")
+		require.NoError(t, err)
+		require.NotNil(t, gitops)
+		assert.Len(t, gitops.Repositories, 1)
+
+		_, err = client.GetGitOps("myorg", "withgitops")
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("revalidated", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+		gitops, err := client.GetGitOps("myorg", "withgitops")
+		require.NoError(t, err)
+		require.NotNil(t, gitops)
+		assert.Len(t, gitops.Repositories, 1)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+	})
+
+	t.Run("notFoundCached", func(t *testing.T) {
+		before := atomic.LoadInt32(&requests)
+		gitops, err := client.GetGitOps("myorg", "nogitops")
+		require.NoError(t, err)
+		assert.Nil(t, gitops)
+		gitops, err = client.GetGitOps("myorg", "nogitops")
+		require.NoError(t, err)
+		assert.Nil(t, gitops)
+		assert.Equal(t, before+1, atomic.LoadInt32(&requests))
+	})
+}
+
+func TestGetOrgGitOps(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/myorg/.github/contents/gitops.yaml":
+			fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`,
+				base64.StdEncoding.EncodeToString([]byte("policies:\n  - targets: [\"github.com/myorg/*\"]\n    repos:\n      - github.com/myorg/deployer\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t, srv)
+	orgGitOps, err := client.GetOrgGitOps("myorg")
+	require.NoError(t, err)
+	assert.Nil(t, orgGitOps, "org policy files are disabled unless configured")
+
+	client.Config.OrgGitOps = &config.ConfigOrgGitOps{}
+	orgGitOps, err = client.GetOrgGitOps("myorg")
+	require.NoError(t, err)
+	require.NotNil(t, orgGitOps)
+	assert.Equal(t, "myorg/.github/gitops.yaml", orgGitOps.Source)
+	assert.NotNil(t, orgGitOps.For(repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"}))
+
+	client.Config.OrgGitOps = &config.ConfigOrgGitOps{Repo: "policies"}
+	orgGitOps, err = client.GetOrgGitOps("myorg")
+	require.NoError(t, err)
+	assert.Nil(t, orgGitOps)
+}
+
+func TestGetOrgGitOpsSharedFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/myorg/.github/contents/gitops.yaml":
+			fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`,
+				base64.StdEncoding.EncodeToString([]byte("policies:\n  - targets: [\"github.com/myorg/*\"]\n    repos:\n      - github.com/myorg/deployer\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	// the org policy file is also the gitops.yaml of the .github repository, both must be cached separately
+	tests := []struct {
+		name           string
+		orgGitOpsFirst bool
+	}{
+		{name: "repoFirst"},
+		{name: "orgFirst", orgGitOpsFirst: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, srv).WithGitOpsCache(time.Minute, time.Minute, 10)
+			client.Config.OrgGitOps = &config.ConfigOrgGitOps{}
+
+			var orgGitOps *OrgGitOps
+			var err error
+			if tt.orgGitOpsFirst {
+				orgGitOps, err = client.GetOrgGitOps("myorg")
+				require.NoError(t, err)
+			}
+			gitops, err := client.GetGitOps("myorg", ".github")
+			require.NoError(t, err)
+			require.NotNil(t, gitops)
+			assert.Empty(t, gitops.Repositories)
+			if !tt.orgGitOpsFirst {
+				orgGitOps, err = client.GetOrgGitOps("myorg")
+				require.NoError(t, err)
+			}
+
+			require.NotNil(t, orgGitOps)
+			assert.NotNil(t, orgGitOps.For(repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"}))
+		})
+	}
+}
+
+func TestGetGitOpsConfigured(t *testing.T) {
+	var refs []string
+	var repoLookups int32
+	protected := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/myorg/x":
+			atomic.AddInt32(&repoLookups, 1)
+			fmt.Fprint(w, `{"name": "x", "default_branch": "main"}`)
+		case "/repos/myorg/x/branches/main":
+			fmt.Fprintf(w, `{"name": "main", "protected": %t}`, protected)
+		case "/repos/myorg/x/contents/.buildkite/gitops.json":
+			refs = append(refs, r.URL.Query().Get("ref"))
+			fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`,
+				base64.StdEncoding.EncodeToString([]byte(`{"repos": ["github.com/myorg/deployer"]}`)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t, srv)
+	client.Config.GitOps = config.ConfigGitOps{Paths: []string{"gitops.yaml", ".buildkite/gitops.json"}}
+
+	t.Run("fallbackPath", func(t *testing.T) {
+		refs = nil
+		gitops, err := client.GetGitOps("myorg", "x")
+		require.NoError(t, err)
+		require.NotNil(t, gitops)
+		assert.Equal(t, ".buildkite/gitops.json", gitops.Source)
+		assert.Len(t, gitops.Repositories, 1)
+		assert.Equal(t, []string{"HEAD"}, refs)
+	})
+
+	t.Run("defaultBranch", func(t *testing.T) {
+		refs = nil
+		client.Config.GitOps.Ref = config.GitOpsRefDefaultBranch
+		_, err := client.GetGitOps("myorg", "x")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"refs/heads/main"}, refs)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&repoLookups), "resolved once for all paths")
+	})
+
+	t.Run("unprotectedBranch", func(t *testing.T) {
+		client.Config.GitOps.Ref = config.GitOpsRefProtected
+		_, err := client.GetGitOps("myorg", "x")
+		var unprotected *UnprotectedBranchError
+		require.ErrorAs(t, err, &unprotected)
+		assert.Equal(t, "main", unprotected.Branch)
+
+		protected = true
+		gitops, err := client.GetGitOps("myorg", "x")
+		require.NoError(t, err)
+		assert.NotNil(t, gitops)
+	})
+
+	t.Run("refCached", func(t *testing.T) {
+		cached := newTestClient(t, srv).WithGitOpsCache(time.Minute, time.Minute, 10)
+		cached.Config.GitOps = config.ConfigGitOps{Paths: []string{"gitops.yaml", ".buildkite/gitops.json"}, Ref: config.GitOpsRefDefaultBranch}
+		before := atomic.LoadInt32(&repoLookups)
+		for i := 0; i < 3; i++ {
+			gitops, err := cached.GetGitOps("myorg", "x")
+			require.NoError(t, err)
+			assert.NotNil(t, gitops)
+		}
+		assert.Equal(t, before+1, atomic.LoadInt32(&repoLookups))
+	})
+}
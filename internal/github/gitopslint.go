@@ -0,0 +1,87 @@
+package github
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LintSeverity tells whether a lint problem makes the server reject or misread a gitops.yaml
+type LintSeverity string
+
+const (
+	LintError   LintSeverity = "error"
+	LintWarning LintSeverity = "warning"
+)
+
+// LintProblem is a single finding of LintGitOps
+type LintProblem struct {
+	Severity LintSeverity
+	Message  string
+}
+
+func (p LintProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+}
+
+// LintGitOps parses a gitops file in the given format ("yaml" or "json") the same way the server does and reports
+// problems the server would silently ignore, such as unknown keys, and warns about overly broad patterns. It returns
+// the parsed file, or nil if it cannot be parsed.
+func LintGitOps(contents string, format string) (*GitOps, []LintProblem) {
+	problems := make([]LintProblem, 0)
+
+	if format == "json" {
+		// JSON files are parsed strictly by the server already
+		gitops, err := GitOpsFromJSON(contents)
+		if err != nil {
+			return nil, append(problems, LintProblem{Severity: LintError, Message: err.Error()})
+		}
+		return &gitops, lintRepositories(gitops, problems)
+	}
+
+	gitops, err := GitOpsFromString(contents)
+	if err != nil {
+		return nil, append(problems, LintProblem{Severity: LintError, Message: err.Error()})
+	}
+
+	// The server ignores unknown keys, which usually are typos such as "branch" instead of "branches"
+	strict := &GitOps{}
+	if err := yaml.UnmarshalStrict([]byte(contents), strict); err != nil {
+		problems = append(problems, LintProblem{Severity: LintError, Message: err.Error()})
+	}
+	return &gitops, lintRepositories(gitops, problems)
+}
+
+// lintRepositories warns about missing and overly broad repository entries
+func lintRepositories(gitops GitOps, problems []LintProblem) []LintProblem {
+	if len(gitops.Repositories) == 0 {
+		problems = append(problems, LintProblem{Severity: LintWarning, Message: "no repos listed, no other repository is granted access"})
+	}
+	for _, repo := range gitops.Repositories {
+		if repo.Repository.Negated {
+			continue
+		}
+		// entries list the pipeline repositories which may access this repository. Host globs use '.' as
+		// separator, so a wildcard host only matches the hosts of its shape rather than every host.
+		if isWildcard(repo.Repository.Host) {
+			problems = append(problems, LintProblem{
+				Severity: LintWarning,
+				Message: fmt.Sprintf("repo %s: pipelines building matching repositories on any host matching %s get %s access to this repository",
+					repo.Repository, repo.Repository.Host, repo.Access),
+			})
+		} else if isWildcard(repo.Repository.Org) {
+			problems = append(problems, LintProblem{
+				Severity: LintWarning,
+				Message: fmt.Sprintf("repo %s: pipelines building matching repositories of every org on %s get %s access to this repository",
+					repo.Repository, repo.Repository.Host, repo.Access),
+			})
+		}
+	}
+	return problems
+}
+
+// isWildcard returns true if a glob pattern matches any name
+func isWildcard(pattern string) bool {
+	return pattern != "" && strings.Trim(pattern, "*") == ""
+}
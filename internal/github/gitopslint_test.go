@@ -0,0 +1,107 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintGitOps(t *testing.T) {
+	tests := []struct {
+		name         string
+		contents     string
+		wantParsed   bool
+		wantErrors   int
+		wantWarnings int
+	}{
+		{
+			name:       "valid",
+			contents:   "repos:\n  - github.com/myorg/deployer\n  - repo: github.com/myorg/*\n    access: read\n    branches: [main]\n",
+			wantParsed: true,
+		},
+		{
+			name:       "unknownKey",
+			contents:   "repos:\n  - repo: github.com/myorg/deployer\n    branch: [main]\n",
+			wantParsed: true,
+			wantErrors: 1,
+		},
+		{
+			name:       "unknownTopLevelKey",
+			contents:   "repositories:\n  - github.com/myorg/deployer\n",
+			wantParsed: true,
+			wantErrors: 1,
+			// the typo leaves repos empty
+			wantWarnings: 1,
+		},
+		{
+			name:       "invalidGlob",
+			contents:   "repos:\n  - github.com/myorg/deploy[er\n",
+			wantErrors: 1,
+		},
+		{
+			name:         "broadWildcard",
+			contents:     "repos:\n  - github.com/*/*\n",
+			wantParsed:   true,
+			wantWarnings: 1,
+		},
+		{
+			name:         "hostWildcard",
+			contents:     "repos:\n  - https://*/myorg/deployer\n",
+			wantParsed:   true,
+			wantWarnings: 1,
+		},
+		{
+			name:       "negatedWildcard",
+			contents:   "repos:\n  - github.com/myorg/*\n  - \"!github.com/*/legacy-*\"\n",
+			wantParsed: true,
+		},
+		{
+			name:       "invalidRepo",
+			contents:   "repos:\n  - notarepo\n",
+			wantErrors: 1,
+		},
+		{
+			name:       "invalidAccess",
+			contents:   "repos:\n  - repo: github.com/myorg/deployer\n    access: owner\n",
+			wantErrors: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitops, problems := LintGitOps(tt.contents, "yaml")
+			assert.Equal(t, tt.wantParsed, gitops != nil)
+
+			errors, warnings := 0, 0
+			for _, problem := range problems {
+				switch problem.Severity {
+				case LintError:
+					errors++
+				case LintWarning:
+					warnings++
+				}
+			}
+			require.Equal(t, tt.wantErrors, errors, "errors: %v", problems)
+			require.Equal(t, tt.wantWarnings, warnings, "warnings: %v", problems)
+		})
+	}
+
+	t.Run("hostWildcardMessage", func(t *testing.T) {
+		_, problems := LintGitOps("repos:\n  - repo: https://*/myorg/deployer\n    access: write\n", "yaml")
+		require.Len(t, problems, 1)
+		assert.Equal(t, "repo */myorg/deployer: pipelines building matching repositories on any host matching * get write access to this repository", problems[0].Message)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		gitops, problems := LintGitOps(`{"repos": ["github.com/*/deployer"]}`, "json")
+		require.NotNil(t, gitops)
+		require.Len(t, problems, 1)
+		assert.Equal(t, LintWarning, problems[0].Severity)
+		assert.Equal(t, "repo github.com/*/deployer: pipelines building matching repositories of every org on github.com get write access to this repository", problems[0].Message)
+
+		gitops, problems = LintGitOps(`{"repos": [{"repo": "github.com/myorg/deployer", "branch": "main"}]}`, "json")
+		assert.Nil(t, gitops)
+		require.Len(t, problems, 1)
+		assert.Equal(t, LintError, problems[0].Severity)
+	})
+}
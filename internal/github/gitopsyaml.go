@@ -1,21 +1,76 @@
 package github
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
 	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
 )
 
 type rawGitOps struct {
-	ProtectedDestinations []string `yaml:"protectedDestinations"`
-	Repositories          []string `yaml:"repos"`
+	ProtectedDestinations []string              `yaml:"protectedDestinations" json:"protectedDestinations"`
+	Repositories          []rawGitOpsRepository `yaml:"repos" json:"repos"`
+}
+
+// rawGitOpsRepository is either a plain repository string or a map with an access level, permissions and conditions
+type rawGitOpsRepository struct {
+	Repo                      string          `yaml:"repo" json:"repo"`
+	Access                    api.AccessLevel `yaml:"access" json:"access"`
+	Permissions               api.Permissions `yaml:"permissions" json:"permissions"`
+	buildkite.ClaimConditions `yaml:",inline"`
+}
+
+// UnmarshalYAML accepts both "- github.com/org/repo" and "- repo: github.com/org/repo" entries
+func (r *rawGitOpsRepository) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var repo string
+	if err := unmarshal(&repo); err == nil {
+		r.Repo = repo
+		return nil
+	}
+
+	type repositoryEntry rawGitOpsRepository
+	return unmarshal((*repositoryEntry)(r))
+}
+
+// UnmarshalJSON accepts both "github.com/org/repo" and {"repo": "github.com/org/repo"} entries
+func (r *rawGitOpsRepository) UnmarshalJSON(data []byte) error {
+	var repo string
+	if err := json.Unmarshal(data, &repo); err == nil {
+		r.Repo = repo
+		return nil
+	}
+
+	type repositoryEntry rawGitOpsRepository
+	return strictJSONUnmarshal(data, (*repositoryEntry)(r))
 }
 
 type GitOps struct {
+	// Source is the path the file was read from, if it was read from a repository
+	Source string
+
 	ProtectedDestinations []string
-	Repositories          []repoparser.RepositoryName
+	Repositories          []GitOpsRepository
+}
+
+// GitOpsRepository is a single entry in the gitops.yaml "repos" list
+type GitOpsRepository struct {
+	// Repository is the glob-style repository granted access. Negated entries such as "!github.com/myorg/legacy-*"
+	// (quoted, YAML reserves a leading "!") exclude the repositories they match from all other entries.
+	Repository repoparser.RepositoryPattern
+
+	// Access is the highest access level granted, defaults to write
+	Access api.AccessLevel
+
+	// Permissions optionally restricts the granted permissions. If empty, any permission up to Access is granted.
+	Permissions api.Permissions
+
+	// Conditions optionally restricts the entry to builds with matching OIDC claims, e.g. only the main branch
+	Conditions buildkite.ClaimConditions
 }
 
 // UnmarshalYAML is a custom unmarshaller that ensures all "repositories" point to a valid repository name
@@ -25,15 +80,45 @@ func (g *GitOps) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	return g.fromRaw(raw)
+}
+
+// UnmarshalJSON is the JSON equivalent of UnmarshalYAML
+func (g *GitOps) UnmarshalJSON(data []byte) error {
+	raw := rawGitOps{}
+	if err := strictJSONUnmarshal(data, &raw); err != nil {
+		return err
+	}
+	return g.fromRaw(raw)
+}
 
+// fromRaw validates and compiles a raw gitops.yaml
+func (g *GitOps) fromRaw(raw rawGitOps) error {
 	g.ProtectedDestinations = raw.ProtectedDestinations
-	g.Repositories = make([]repoparser.RepositoryName, len(raw.Repositories))
-	for idx, repoString := range raw.Repositories {
-		repo, err := repoparser.ExtractOrgRepoFromURL(repoString)
+	g.Repositories = make([]GitOpsRepository, len(raw.Repositories))
+	for idx, rawRepo := range raw.Repositories {
+		repo, err := repoparser.ParsePattern(rawRepo.Repo)
 		if err != nil {
-			return fmt.Errorf("cannot parse repo %s: %w", repoString, err)
+			return fmt.Errorf("cannot parse repo %s: %w", rawRepo.Repo, err)
+		}
+		if rawRepo.Access == "" {
+			rawRepo.Access = api.AccessLevelWrite
+		}
+		if !rawRepo.Access.Valid() {
+			return fmt.Errorf("invalid access %s for repo %s", rawRepo.Access, rawRepo.Repo)
+		}
+		if err := rawRepo.Permissions.Validate(); err != nil {
+			return fmt.Errorf("invalid permissions for repo %s: %w", rawRepo.Repo, err)
+		}
+		if err := rawRepo.ClaimConditions.Compile(); err != nil {
+			return fmt.Errorf("invalid conditions for repo %s: %w", rawRepo.Repo, err)
+		}
+		g.Repositories[idx] = GitOpsRepository{
+			Repository:  repo,
+			Access:      rawRepo.Access,
+			Permissions: rawRepo.Permissions,
+			Conditions:  rawRepo.ClaimConditions,
 		}
-		g.Repositories[idx] = repo
 	}
 	return nil
 }
@@ -44,12 +129,66 @@ func GitOpsFromString(contents string) (GitOps, error) {
 	return *gitops, err
 }
 
-// RepositoryPermitted returns true if a given repository is in the permitted list
+// GitOpsFromJSON parses the JSON form of a gitops.yaml, e.g. {"repos": ["github.com/myorg/deployer"]}
+func GitOpsFromJSON(contents string) (GitOps, error) {
+	gitops := &GitOps{}
+	err := json.Unmarshal([]byte(contents), gitops)
+	return *gitops, err
+}
+
+// strictJSONUnmarshal rejects unknown keys, which usually are typos. Unlike YAML files, which predate the JSON
+// format, no existing JSON files can break.
+func strictJSONUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// RepositoryPermitted returns true if a given repository is in the permitted list and not excluded by a negated entry
 func (g GitOps) RepositoryPermitted(repo repoparser.RepositoryName) bool {
+	patterns := make([]repoparser.RepositoryPattern, len(g.Repositories))
+	for idx, r := range g.Repositories {
+		patterns[idx] = r.Repository
+	}
+	return repoparser.MatchesAny(patterns, repo)
+}
+
+// PermittedPermissions returns the highest permissions out of the requested ones that a given repository
+// is granted for a build with the given claims. The second return value is false if no entry for the
+// repository applies to the build, or a negated entry excludes it.
+func (g GitOps) PermittedPermissions(repo repoparser.RepositoryName, claims buildkite.Claims, requested api.Permissions) (api.Permissions, bool) {
+	var permitted api.Permissions
 	for _, r := range g.Repositories {
-		if r.Matches(repo) {
-			return true
+		if !r.Repository.Matches(repo) || !r.Conditions.Matches(claims) {
+			continue
+		}
+		if r.Repository.Negated {
+			return nil, false
+		}
+		permitted = permitted.Union(r.Permit(requested))
+	}
+	return permitted, permitted != nil
+}
+
+// Permit returns the subset of the requested permissions allowed by this entry, capped at the granted levels
+func (r GitOpsRepository) Permit(requested api.Permissions) api.Permissions {
+	permitted := requested.Cap(r.Access)
+	if len(r.Permissions) > 0 {
+		permitted = permitted.Restrict(r.Permissions)
+	}
+	return permitted
+}
+
+// Trace compares every entry with a given repository and build claims, to explain PermittedPermissions
+func (g GitOps) Trace(repo repoparser.RepositoryName, claims buildkite.Claims) []api.GitOpsEntryTrace {
+	entries := make([]api.GitOpsEntryTrace, len(g.Repositories))
+	for idx, r := range g.Repositories {
+		entries[idx] = api.GitOpsEntryTrace{
+			Repository:        r.Repository.String(),
+			Access:            r.Access,
+			RepositoryMatches: r.Repository.Matches(repo),
+			ConditionsMatch:   r.Conditions.Matches(claims),
 		}
 	}
-	return false
+	return entries
 }
@@ -3,8 +3,24 @@ package github
 import (
 	"reflect"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
 )
 
+func mustParsePattern(t *testing.T, pattern string) repoparser.RepositoryPattern {
+	t.Helper()
+	p, err := repoparser.ParsePattern(pattern)
+	if err != nil {
+		t.Fatalf("cannot parse pattern %s: %s", pattern, err)
+	}
+	return p
+}
+
 func TestGitOpsFromString(t *testing.T) {
 	type args struct {
 		contents string
@@ -15,7 +31,45 @@ func TestGitOpsFromString(t *testing.T) {
 		want    GitOps
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: "protectedDestinations",
+			args: args{contents: "protectedDestinations:\n  - main\n  - deploy/*\nrepos:\n  - github.com/myorg/deployer\n"},
+			want: GitOps{
+				ProtectedDestinations: []string{"main", "deploy/*"},
+				Repositories: []GitOpsRepository{
+					{Repository: mustParsePattern(t, "github.com/myorg/deployer"), Access: api.AccessLevelWrite},
+				},
+			},
+		},
+		{
+			name: "accessLevels",
+			args: args{contents: "repos:\n  - repo: github.com/myorg/reader\n    access: read\n  - repo: github.com/myorg/checker\n    permissions:\n      checks: write\n"},
+			want: GitOps{
+				Repositories: []GitOpsRepository{
+					{Repository: mustParsePattern(t, "github.com/myorg/reader"), Access: api.AccessLevelRead},
+					{
+						Repository:  mustParsePattern(t, "github.com/myorg/checker"),
+						Access:      api.AccessLevelWrite,
+						Permissions: api.Permissions{"checks": api.AccessLevelWrite},
+					},
+				},
+			},
+		},
+		{
+			name:    "invalidAccess",
+			args:    args{contents: "repos:\n  - repo: github.com/myorg/reader\n    access: everything\n"},
+			wantErr: true,
+		},
+		{
+			name:    "invalidRepo",
+			args:    args{contents: "repos:\n  - notarepo\n"},
+			wantErr: true,
+		},
+		{
+			name:    "invalidGlob",
+			args:    args{contents: "repos:\n  - github.com/myorg/deploy[er\n"},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -24,9 +78,146 @@ func TestGitOpsFromString(t *testing.T) {
 				t.Errorf("GitOpsFromString() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErr {
+				return
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("GitOpsFromString() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestGitOpsFromJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     GitOps
+		wantErr  bool
+	}{
+		{
+			name:     "stringAndObjectEntries",
+			contents: `{"protectedDestinations": ["main"], "repos": ["github.com/myorg/deployer", {"repo": "github.com/myorg/reader", "access": "read"}]}`,
+			want: GitOps{
+				ProtectedDestinations: []string{"main"},
+				Repositories: []GitOpsRepository{
+					{Repository: mustParsePattern(t, "github.com/myorg/deployer"), Access: api.AccessLevelWrite},
+					{Repository: mustParsePattern(t, "github.com/myorg/reader"), Access: api.AccessLevelRead},
+				},
+			},
+		},
+		{
+			name:     "unknownKey",
+			contents: `{"repositories": ["github.com/myorg/deployer"]}`,
+			wantErr:  true,
+		},
+		{
+			name:     "unknownEntryKey",
+			contents: `{"repos": [{"repo": "github.com/myorg/reader", "acess": "read"}]}`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalidRepo",
+			contents: `{"repos": ["notarepo"]}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GitOpsFromJSON(tt.contents)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGitOpsPermittedPermissions(t *testing.T) {
+	gitops, err := GitOpsFromString(`repos:
+  - repo: github.com/myorg/reader
+    access: read
+  - repo: github.com/myorg/checker
+    permissions:
+      checks: write
+  - repo: github.com/myorg/*
+    access: read
+    permissions:
+      contents: read
+  - "!github.com/myorg/legacy-*"
+`)
+	if err != nil {
+		t.Fatalf("cannot parse gitops: %s", err)
+	}
+	requested := api.Permissions{
+		"metadata": api.AccessLevelRead,
+		"contents": api.AccessLevelWrite,
+		"checks":   api.AccessLevelWrite,
+	}
+
+	t.Run("readOnly", func(t *testing.T) {
+		permitted, listed := gitops.PermittedPermissions(repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "reader"}, buildkite.Claims{}, requested)
+		assert.True(t, listed)
+		assert.Equal(t, api.Permissions{
+			"metadata": api.AccessLevelRead,
+			"contents": api.AccessLevelRead,
+			"checks":   api.AccessLevelRead,
+		}, permitted)
+	})
+	t.Run("mergedEntries", func(t *testing.T) {
+		permitted, listed := gitops.PermittedPermissions(repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "checker"}, buildkite.Claims{}, requested)
+		assert.True(t, listed)
+		assert.Equal(t, api.Permissions{
+			"metadata": api.AccessLevelRead,
+			"contents": api.AccessLevelRead,
+			"checks":   api.AccessLevelWrite,
+		}, permitted)
+	})
+	t.Run("notListed", func(t *testing.T) {
+		_, listed := gitops.PermittedPermissions(repoparser.RepositoryName{Host: "github.com", Org: "otherorg", Repo: "checker"}, buildkite.Claims{}, requested)
+		assert.False(t, listed)
+	})
+	t.Run("negated", func(t *testing.T) {
+		legacy := repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "legacy-deployer"}
+		_, listed := gitops.PermittedPermissions(legacy, buildkite.Claims{}, requested)
+		assert.False(t, listed)
+		assert.False(t, gitops.RepositoryPermitted(legacy))
+	})
+}
+
+func TestGitOpsConditions(t *testing.T) {
+	gitops, err := GitOpsFromString(`repos:
+  - repo: github.com/myorg/deployer
+    branches: ["main"]
+    buildSources: ["webhook", "ui"]
+  - repo: github.com/myorg/deployer
+    access: read
+`)
+	if err != nil {
+		t.Fatalf("cannot parse gitops: %s", err)
+	}
+	deployer := repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "deployer"}
+	requested := api.Permissions{"contents": api.AccessLevelWrite}
+
+	t.Run("mainBranch", func(t *testing.T) {
+		permitted, listed := gitops.PermittedPermissions(deployer, buildkite.Claims{BuildBranch: "main", BuildSource: "webhook"}, requested)
+		assert.True(t, listed)
+		assert.Equal(t, api.Permissions{"contents": api.AccessLevelWrite}, permitted)
+	})
+	t.Run("featureBranch", func(t *testing.T) {
+		permitted, listed := gitops.PermittedPermissions(deployer, buildkite.Claims{BuildBranch: "feature", BuildSource: "webhook"}, requested)
+		assert.True(t, listed)
+		assert.Equal(t, api.Permissions{"contents": api.AccessLevelRead}, permitted)
+	})
+	t.Run("apiBuildOnMain", func(t *testing.T) {
+		permitted, listed := gitops.PermittedPermissions(deployer, buildkite.Claims{BuildBranch: "main", BuildSource: "api"}, requested)
+		assert.True(t, listed)
+		assert.Equal(t, api.Permissions{"contents": api.AccessLevelRead}, permitted)
+	})
+	t.Run("invalidCondition", func(t *testing.T) {
+		_, err := GitOpsFromString("repos:\n  - repo: github.com/myorg/deployer\n    branches: [\"[\"]\n")
+		assert.Error(t, err)
+	})
+}
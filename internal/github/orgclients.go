@@ -0,0 +1,187 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v48/github"
+	"go.uber.org/zap"
+)
+
+const (
+	// orgClientMinLifetime is the least remaining token lifetime for a cached org client to be handed out
+	orgClientMinLifetime = 30 * time.Second
+
+	// orgClientRefreshBefore is how long before its token expires the background refresher replaces an org client
+	orgClientRefreshBefore = 10 * time.Minute
+
+	// orgClientIdleTimeout is how long an org client is kept without being used. Idle clients are dropped instead
+	// of refreshed, and minted again on the next use.
+	orgClientIdleTimeout = time.Hour
+)
+
+// OrgClient is a GitHub client authenticated with an installation token of a single org
+type OrgClient struct {
+	ExpiresAt      time.Time
+	Client         *github.Client
+	InstallationID int64
+
+	// lastUsed is when ClientForOrg last handed out the client, guarded by orgClientCache.mu
+	lastUsed time.Time
+}
+
+// orgClientCache holds one OrgClient per org. It is safe for concurrent use, concurrent misses
+// for the same org share a single installation token.
+type orgClientCache struct {
+	mu       sync.Mutex
+	clients  map[string]*OrgClient
+	inflight map[string]*orgClientCall
+}
+
+// orgClientCall is a token mint in progress which other callers wait for
+type orgClientCall struct {
+	done   chan struct{}
+	client *OrgClient
+	err    error
+}
+
+// ClientForOrg returns a GitHub client with read access to contents and metadata for a given org
+func (c *Client) ClientForOrg(org string) (*github.Client, int64, error) {
+	c.orgClients.mu.Lock()
+	if cached, ok := c.orgClients.clients[org]; ok && time.Until(cached.ExpiresAt) > orgClientMinLifetime {
+		cached.lastUsed = time.Now()
+		c.orgClients.mu.Unlock()
+		return cached.Client, cached.InstallationID, nil
+	}
+	c.orgClients.mu.Unlock()
+
+	orgClient, err := c.refreshOrgClient(org)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.orgClients.mu.Lock()
+	orgClient.lastUsed = time.Now()
+	c.orgClients.mu.Unlock()
+	return orgClient.Client, orgClient.InstallationID, nil
+}
+
+// RefreshOrgClients replaces org clients in the background before their tokens expire. Clients which were not
+// used for orgClientIdleTimeout, or cannot be refreshed, e.g. because the app was uninstalled, are dropped.
+// It blocks until ctx is done.
+func (c *Client) RefreshOrgClients(ctx context.Context, logger *zap.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, org := range c.expiringOrgs() {
+				if _, err := c.refreshOrgClient(org); err != nil {
+					logger.Warn("cannot refresh github org client, dropping it",
+						zap.String("host", c.Config.Host),
+						zap.String("org", org),
+						zap.Error(err),
+					)
+					c.dropOrgClient(org)
+				}
+			}
+		}
+	}
+}
+
+// expiringOrgs returns the orgs whose clients expire within orgClientRefreshBefore, and drops idle clients
+func (c *Client) expiringOrgs() []string {
+	c.orgClients.mu.Lock()
+	defer c.orgClients.mu.Unlock()
+
+	orgs := make([]string, 0)
+	for org, cached := range c.orgClients.clients {
+		if time.Since(cached.lastUsed) > orgClientIdleTimeout {
+			delete(c.orgClients.clients, org)
+			continue
+		}
+		if time.Until(cached.ExpiresAt) < orgClientRefreshBefore {
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs
+}
+
+// dropOrgClient removes the cached client of an org
+func (c *Client) dropOrgClient(org string) {
+	c.orgClients.mu.Lock()
+	defer c.orgClients.mu.Unlock()
+	delete(c.orgClients.clients, org)
+}
+
+// refreshOrgClient mints a new org client and caches it. Concurrent calls for the same org share one result.
+func (c *Client) refreshOrgClient(org string) (*OrgClient, error) {
+	c.orgClients.mu.Lock()
+	if call, ok := c.orgClients.inflight[org]; ok {
+		c.orgClients.mu.Unlock()
+		<-call.done
+		return call.client, call.err
+	}
+
+	// Keep the cached installation ID to save us one API call to github
+	var installationID int64
+	lastUsed := time.Now()
+	if cached, ok := c.orgClients.clients[org]; ok {
+		installationID = cached.InstallationID
+		lastUsed = cached.lastUsed
+	}
+	call := &orgClientCall{done: make(chan struct{})}
+	if c.orgClients.inflight == nil {
+		c.orgClients.inflight = make(map[string]*orgClientCall)
+	}
+	c.orgClients.inflight[org] = call
+	c.orgClients.mu.Unlock()
+
+	call.client, call.err = c.newOrgClient(org, installationID)
+
+	c.orgClients.mu.Lock()
+	delete(c.orgClients.inflight, org)
+	if call.err == nil {
+		if c.orgClients.clients == nil {
+			c.orgClients.clients = make(map[string]*OrgClient)
+		}
+		// a background refresh does not count as use
+		call.client.lastUsed = lastUsed
+		c.orgClients.clients[org] = call.client
+	}
+	c.orgClients.mu.Unlock()
+	close(call.done)
+
+	return call.client, call.err
+}
+
+// newOrgClient creates an installation token with read access to an org's contents and a client using it
+func (c *Client) newOrgClient(org string, installationID int64) (*OrgClient, error) {
+	if installationID == 0 {
+		installation, _, err := c.Client.Apps.FindOrganizationInstallation(context.TODO(), org)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find github app installation for organization %s: %w", org, err)
+		}
+		installationID = installation.GetID()
+	}
+
+	// Create new static token so we can access org contents, do not limit to repos
+	token, _, err := c.Client.Apps.CreateInstallationToken(context.TODO(), installationID, &github.InstallationTokenOptions{
+		Permissions: &github.InstallationPermissions{
+			Contents: github.String("read"),
+			Metadata: github.String("read"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrgClient{
+		Client:         c.tokenClient(token.GetToken()),
+		ExpiresAt:      token.GetExpiresAt(),
+		InstallationID: installationID,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// fakeAppServer is a GitHub API stand-in which hands out installation tokens valid for tokenLifetime
+type fakeAppServer struct {
+	*httptest.Server
+	tokenLifetime time.Duration
+	mints         int32
+	lookups       int32
+}
+
+func newFakeAppServer(t *testing.T, tokenLifetime time.Duration) *fakeAppServer {
+	t.Helper()
+	fake := &fakeAppServer{tokenLifetime: tokenLifetime}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/orgs/") && strings.HasSuffix(r.URL.Path, "/installation"):
+			atomic.AddInt32(&fake.lookups, 1)
+			fmt.Fprint(w, `{"id": 1}`)
+		case r.URL.Path == "/app/installations/1/access_tokens":
+			n := atomic.AddInt32(&fake.mints, 1)
+			// slow down minting so concurrent callers pile up
+			time.Sleep(10 * time.Millisecond)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "token-%d", "expires_at": %q}`, n, time.Now().Add(fake.tokenLifetime).Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeAppServer) client(t *testing.T) *Client {
+	t.Helper()
+	return &Client{
+		Client: newTestGitHubClient(t, f.Server),
+		Config: &config.ConfigApplication{Host: "github.com"},
+	}
+}
+
+func TestClientForOrgConcurrency(t *testing.T) {
+	fake := newFakeAppServer(t, time.Hour)
+	client := fake.client(t)
+
+	orgs := []string{"org1", "org2", "org3", "org4", "org5"}
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			org := orgs[i%len(orgs)]
+			orgClient, installationID, err := client.ClientForOrg(org)
+			assert.NoError(t, err)
+			assert.NotNil(t, orgClient)
+			assert.Equal(t, int64(1), installationID)
+		}(i)
+		if i%20 == 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client.expiringOrgs()
+			}()
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(len(orgs)), atomic.LoadInt32(&fake.mints), "one token per org")
+	assert.Equal(t, int32(len(orgs)), atomic.LoadInt32(&fake.lookups), "one installation lookup per org")
+}
+
+func TestRefreshOrgClients(t *testing.T) {
+	// tokens expire well within orgClientRefreshBefore, so the refresher replaces them on every tick
+	fake := newFakeAppServer(t, 5*time.Minute)
+	client := fake.client(t)
+
+	first, _, err := client.ClientForOrg("org1")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.RefreshOrgClients(ctx, zap.NewNop(), 10*time.Millisecond)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&fake.mints) >= 2
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+
+	refreshed, _, err := client.ClientForOrg("org1")
+	require.NoError(t, err)
+	assert.NotSame(t, first, refreshed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fake.lookups), "installation ID is reused")
+}
+
+func TestRefreshOrgClientsEviction(t *testing.T) {
+	fake := newFakeAppServer(t, 5*time.Minute)
+	client := fake.client(t)
+
+	for _, org := range []string{"used", "idle"} {
+		_, _, err := client.ClientForOrg(org)
+		require.NoError(t, err)
+	}
+	client.orgClients.mu.Lock()
+	client.orgClients.clients["idle"].lastUsed = time.Now().Add(-2 * orgClientIdleTimeout)
+	// the fake server only knows installation 1, as if the app was uninstalled from this org
+	client.orgClients.clients["uninstalled"] = &OrgClient{
+		ExpiresAt:      time.Now().Add(time.Minute),
+		InstallationID: 2,
+		lastUsed:       time.Now(),
+	}
+	client.orgClients.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.RefreshOrgClients(ctx, zap.NewNop(), 10*time.Millisecond)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		client.orgClients.mu.Lock()
+		defer client.orgClients.mu.Unlock()
+		return len(client.orgClients.clients) == 1
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	client.orgClients.mu.Lock()
+	defer client.orgClients.mu.Unlock()
+	assert.Contains(t, client.orgClients.clients, "used")
+}
@@ -0,0 +1,99 @@
+package github
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+// OrgGitOps is an org-wide policy file consulted for repositories without a gitops.yaml of their own.
+// Each policy lists target repositories and the gitops.yaml rules which apply to them:
+//
+//	policies:
+//	  - targets: ["github.com/myorg/service-*", "!github.com/myorg/service-legacy"]
+//	    protectedDestinations: ["main"]
+//	    repos:
+//	      - github.com/myorg/deployer
+//	  - targets: ["github.com/myorg/*"]
+//	    repos:
+//	      - repo: github.com/myorg/docs-builder
+//	        access: read
+type OrgGitOps struct {
+	// Source names the file the policies were read from, e.g. myorg/.github/gitops.yaml
+	Source string
+
+	Policies []OrgGitOpsPolicy
+}
+
+// OrgGitOpsPolicy applies gitops.yaml rules to a set of target repositories
+type OrgGitOpsPolicy struct {
+	Targets []repoparser.RepositoryPattern
+	GitOps
+}
+
+type rawOrgGitOps struct {
+	Policies []OrgGitOpsPolicy `yaml:"policies" json:"policies"`
+}
+
+type rawOrgGitOpsPolicy struct {
+	Targets   []string `yaml:"targets" json:"targets"`
+	rawGitOps `yaml:",inline"`
+}
+
+// UnmarshalYAML ensures all targets and repos are valid repository patterns
+func (p *OrgGitOpsPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := rawOrgGitOpsPolicy{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	return p.fromRaw(raw)
+}
+
+// UnmarshalJSON is the JSON equivalent of UnmarshalYAML
+func (p *OrgGitOpsPolicy) UnmarshalJSON(data []byte) error {
+	raw := rawOrgGitOpsPolicy{}
+	if err := strictJSONUnmarshal(data, &raw); err != nil {
+		return err
+	}
+	return p.fromRaw(raw)
+}
+
+func (p *OrgGitOpsPolicy) fromRaw(raw rawOrgGitOpsPolicy) error {
+	if len(raw.Targets) == 0 {
+		return fmt.Errorf("policy must list at least one target")
+	}
+	p.Targets = make([]repoparser.RepositoryPattern, len(raw.Targets))
+	for idx, target := range raw.Targets {
+		pattern, err := repoparser.ParsePattern(target)
+		if err != nil {
+			return fmt.Errorf("cannot parse target %s: %w", target, err)
+		}
+		p.Targets[idx] = pattern
+	}
+	return p.GitOps.fromRaw(raw.rawGitOps)
+}
+
+func OrgGitOpsFromString(contents string) (OrgGitOps, error) {
+	raw := rawOrgGitOps{}
+	err := yaml.Unmarshal([]byte(contents), &raw)
+	return OrgGitOps{Policies: raw.Policies}, err
+}
+
+// OrgGitOpsFromJSON parses the JSON form of an org-wide policy file
+func OrgGitOpsFromJSON(contents string) (OrgGitOps, error) {
+	raw := rawOrgGitOps{}
+	err := strictJSONUnmarshal([]byte(contents), &raw)
+	return OrgGitOps{Policies: raw.Policies}, err
+}
+
+// For returns the gitops.yaml rules of the first policy targeting a repository, or nil if no policy does
+func (o *OrgGitOps) For(repo repoparser.RepositoryName) *GitOps {
+	for idx, policy := range o.Policies {
+		if repoparser.MatchesAny(policy.Targets, repo) {
+			return &o.Policies[idx].GitOps
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+func TestOrgGitOpsFromString(t *testing.T) {
+	orgGitOps, err := OrgGitOpsFromString(`policies:
+  - targets: ["github.com/myorg/service-*", "!github.com/myorg/service-legacy"]
+    protectedDestinations: ["main"]
+    repos:
+      - github.com/myorg/deployer
+  - targets: ["github.com/myorg/*"]
+    repos:
+      - repo: github.com/myorg/docs-builder
+        access: read
+`)
+	require.NoError(t, err)
+	require.Len(t, orgGitOps.Policies, 2)
+
+	tests := []struct {
+		name      string
+		repo      repoparser.RepositoryName
+		wantRepos []string
+	}{
+		{name: "firstPolicy", repo: repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service-api"}, wantRepos: []string{"github.com/myorg/deployer"}},
+		{name: "negatedFallsThrough", repo: repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service-legacy"}, wantRepos: []string{"github.com/myorg/docs-builder"}},
+		{name: "secondPolicy", repo: repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "website"}, wantRepos: []string{"github.com/myorg/docs-builder"}},
+		{name: "notTargeted", repo: repoparser.RepositoryName{Host: "github.com", Org: "otherorg", Repo: "website"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitops := orgGitOps.For(tt.repo)
+			if tt.wantRepos == nil {
+				assert.Nil(t, gitops)
+				return
+			}
+			require.NotNil(t, gitops)
+			repos := make([]string, len(gitops.Repositories))
+			for idx, r := range gitops.Repositories {
+				repos[idx] = r.Repository.String()
+			}
+			assert.Equal(t, tt.wantRepos, repos)
+		})
+	}
+
+	t.Run("missingTargets", func(t *testing.T) {
+		_, err := OrgGitOpsFromString("policies:\n  - repos:\n      - github.com/myorg/deployer\n")
+		assert.Error(t, err)
+	})
+	t.Run("invalidTarget", func(t *testing.T) {
+		_, err := OrgGitOpsFromString("policies:\n  - targets: [\"github.com/myorg/service-[\"]\n    repos:\n      - github.com/myorg/deployer\n")
+		assert.Error(t, err)
+	})
+}
+
+func TestOrgGitOpsFromJSON(t *testing.T) {
+	orgGitOps, err := OrgGitOpsFromJSON(`{"policies": [{"targets": ["github.com/myorg/*"], "repos": ["github.com/myorg/deployer"]}]}`)
+	require.NoError(t, err)
+	require.Len(t, orgGitOps.Policies, 1)
+	assert.NotNil(t, orgGitOps.For(repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"}))
+
+	_, err = OrgGitOpsFromJSON(`{"policies": [{"targets": ["github.com/myorg/*"], "repo": ["github.com/myorg/deployer"]}]}`)
+	assert.Error(t, err, "unknown keys are rejected")
+}
@@ -0,0 +1,40 @@
+package github
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/go-github/v48/github"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+)
+
+// installationPermissionFields maps GitHub permission names (as used in the API) to their field index
+// in github.InstallationPermissions
+var installationPermissionFields = func() map[string]int {
+	fields := make(map[string]int)
+	t := reflect.TypeOf(github.InstallationPermissions{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}()
+
+// InstallationPermissions converts a permission map into the go-github representation.
+// It returns an error if any permission name is unknown to GitHub.
+func InstallationPermissions(perms api.Permissions) (*github.InstallationPermissions, error) {
+	ret := &github.InstallationPermissions{}
+	v := reflect.ValueOf(ret).Elem()
+	for name, level := range perms {
+		idx, ok := installationPermissionFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown github permission %s", name)
+		}
+		v.Field(idx).Set(reflect.ValueOf(github.String(string(level))))
+	}
+	return ret, nil
+}
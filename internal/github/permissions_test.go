@@ -0,0 +1,36 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v48/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+)
+
+func TestInstallationPermissions(t *testing.T) {
+	t.Run("happyPath", func(t *testing.T) {
+		perms, err := InstallationPermissions(api.Permissions{
+			"metadata":      api.AccessLevelRead,
+			"contents":      api.AccessLevelWrite,
+			"pull_requests": api.AccessLevelWrite,
+			"checks":        api.AccessLevelWrite,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, &github.InstallationPermissions{
+			Metadata:     github.String("read"),
+			Contents:     github.String("write"),
+			PullRequests: github.String("write"),
+			Checks:       github.String("write"),
+		}, perms)
+	})
+
+	t.Run("unknownPermission", func(t *testing.T) {
+		_, err := InstallationPermissions(api.Permissions{
+			"snarf": api.AccessLevelRead,
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,46 @@
+package github
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// newTransport returns the HTTP transport used for all requests to a GitHub host, trusting the configured
+// CA bundle and going through the configured proxy
+func newTransport(app *config.ConfigApplication) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if app.Proxy != "" {
+		proxyURL, err := url.Parse(app.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %w", app.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if app.CABundlePath != "" {
+		pem, err := ioutil.ReadFile(app.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ca bundle: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle %s", app.CABundlePath)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return transport, nil
+}
@@ -8,18 +8,14 @@ import (
 	"go.uber.org/zap"
 )
 
-const (
-	jwksURL = "https://agent.buildkite.com/.well-known/jwks"
-)
-
 type JWKS struct {
 	ctx   context.Context
 	url   string
 	cache *jwk.Cache
 }
 
-func New(logger *zap.Logger, u string) (*JWKS, error) {
-	ctx := context.Background()
+// New fetches a JWKS and keeps refreshing it in the background until ctx is done
+func New(ctx context.Context, logger *zap.Logger, u string) (*JWKS, error) {
 	jwks := &JWKS{
 		ctx: ctx,
 		url: u,
@@ -31,14 +27,14 @@ func New(logger *zap.Logger, u string) (*JWKS, error) {
 
 	_, err := jwks.Refresh()
 	if err != nil {
-		logger.Error("unable to fetch buildkite JWKS",
+		logger.Error("unable to fetch JWKS",
 			zap.Error(err),
-			zap.String("jwks_uri", jwksURL),
+			zap.String("jwks_uri", jwks.url),
 		)
 		return nil, err
 	} else {
-		logger.Info("successfully fetch Buildkite JWKS",
-			zap.String("jwks_uri", jwksURL),
+		logger.Info("successfully fetched JWKS",
+			zap.String("jwks_uri", jwks.url),
 		)
 	}
 
@@ -0,0 +1,75 @@
+package jwks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// issuer holds the signing keys and accepted audiences of a single trusted OIDC issuer
+type issuer struct {
+	audiences []string
+	keys      *JWKS
+}
+
+// Verifier verifies OIDC tokens against a set of trusted issuers, each with its own JWKS
+type Verifier struct {
+	issuers map[string]*issuer
+}
+
+// NewVerifier fetches the JWKS of every issuer. They are refreshed in the background until ctx is done.
+func NewVerifier(ctx context.Context, logger *zap.Logger, issuers []*config.ConfigIssuer) (*Verifier, error) {
+	v := &Verifier{
+		issuers: make(map[string]*issuer),
+	}
+	for _, iss := range issuers {
+		keys, err := New(ctx, logger, iss.JWKSURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch JWKS for issuer %s: %w", iss.Issuer, err)
+		}
+		v.issuers[iss.Issuer] = &issuer{
+			audiences: iss.Audiences,
+			keys:      keys,
+		}
+	}
+	return v, nil
+}
+
+// Verify parses the token and validates:
+//   - the issuer is trusted
+//   - the signature against the issuer's JWKS
+//   - expiry
+//   - not before
+//   - audience is one of the issuer's accepted audiences
+func (v *Verifier) Verify(token []byte) (jwt.Token, error) {
+	unverified, err := jwt.Parse(token, jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return nil, err
+	}
+	iss, ok := v.issuers[unverified.Issuer()]
+	if !ok {
+		return nil, fmt.Errorf("untrusted issuer %s", unverified.Issuer())
+	}
+
+	keyset, err := iss.keys.Get()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get JWKS for issuer %s: %w", unverified.Issuer(), err)
+	}
+	verified, err := jwt.Parse(token, jwt.WithKeySet(keyset), jwt.WithIssuer(unverified.Issuer()))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, aud := range verified.Audience() {
+		for _, accepted := range iss.audiences {
+			if aud == accepted {
+				return verified, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("audience %v not accepted for issuer %s", verified.Audience(), verified.Issuer())
+}
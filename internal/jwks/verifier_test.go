@@ -0,0 +1,89 @@
+package jwks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// newTestIssuer serves a JWKS with a freshly generated key and returns the signing key
+func newTestIssuer(t *testing.T) (*httptest.Server, jwk.Key) {
+	t.Helper()
+	rawKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwk.FromRaw(rawKey)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, "test"))
+	require.NoError(t, key.Set(jwk.AlgorithmKey, jwa.RS256))
+	pubKey, err := key.PublicKey()
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(pubKey))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, key
+}
+
+func signTestToken(t *testing.T, key jwk.Key, issuer string, audience string) []byte {
+	t.Helper()
+	token, err := jwt.NewBuilder().
+		Issuer(issuer).
+		Audience([]string{audience}).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(5 * time.Minute)).
+		Build()
+	require.NoError(t, err)
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, key))
+	require.NoError(t, err)
+	return signed
+}
+
+func TestVerifier(t *testing.T) {
+	issuerA, keyA := newTestIssuer(t)
+	issuerB, keyB := newTestIssuer(t)
+
+	verifier, err := NewVerifier(context.Background(), zap.NewNop(), []*config.ConfigIssuer{
+		{Issuer: "https://a.example.com", JWKSURL: issuerA.URL, Audiences: []string{"https://buildkite.com/org-a", "https://buildkite.com/org-a2"}},
+		{Issuer: "https://b.example.com", JWKSURL: issuerB.URL, Audiences: []string{"https://buildkite.com/org-b"}},
+	})
+	require.NoError(t, err)
+
+	t.Run("issuerA", func(t *testing.T) {
+		token, err := verifier.Verify(signTestToken(t, keyA, "https://a.example.com", "https://buildkite.com/org-a2"))
+		require.NoError(t, err)
+		assert.Equal(t, "https://a.example.com", token.Issuer())
+	})
+	t.Run("issuerB", func(t *testing.T) {
+		_, err := verifier.Verify(signTestToken(t, keyB, "https://b.example.com", "https://buildkite.com/org-b"))
+		require.NoError(t, err)
+	})
+	t.Run("wrongAudience", func(t *testing.T) {
+		_, err := verifier.Verify(signTestToken(t, keyB, "https://b.example.com", "https://buildkite.com/org-a"))
+		require.Error(t, err)
+	})
+	t.Run("wrongKey", func(t *testing.T) {
+		_, err := verifier.Verify(signTestToken(t, keyA, "https://b.example.com", "https://buildkite.com/org-b"))
+		require.Error(t, err)
+	})
+	t.Run("untrustedIssuer", func(t *testing.T) {
+		_, err := verifier.Verify(signTestToken(t, keyA, "https://c.example.com", "https://buildkite.com/org-a"))
+		require.Error(t, err)
+	})
+}
@@ -25,6 +25,17 @@ type Metrics struct {
 	// DB metrics
 	DBLatency *prometheus.HistogramVec
 
+	// Cache metrics
+	CacheRequests  *prometheus.CounterVec
+	CacheEvictions *prometheus.CounterVec
+	CacheSize      *prometheus.GaugeVec
+
+	// GitHubConditionalRequests counts conditional (ETag) requests by result (not_modified, modified, not_found)
+	GitHubConditionalRequests *prometheus.CounterVec
+
+	// ConfigReloads counts config reloads by result (success, failure)
+	ConfigReloads *prometheus.CounterVec
+
 	CircuitTrips *prometheus.GaugeVec
 	PanicCount   prometheus.Counter
 	httpHandler  http.Handler
@@ -126,6 +137,36 @@ func (p *Metrics) RegisterMetrics(reg prometheus.Registerer) {
 	}, []string{"circuit"})
 	reg.MustRegister(p.CircuitTrips)
 
+	p.CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "The total count of cache lookups by result (hit, miss, stale, coalesced)",
+	}, []string{"cache", "result"})
+	reg.MustRegister(p.CacheRequests)
+
+	p.CacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_evictions_total",
+		Help: "The total count of entries evicted because a cache was full",
+	}, []string{"cache"})
+	reg.MustRegister(p.CacheEvictions)
+
+	p.CacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cache_size",
+		Help: "The number of entries in a cache",
+	}, []string{"cache"})
+	reg.MustRegister(p.CacheSize)
+
+	p.GitHubConditionalRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_conditional_requests_total",
+		Help: "The total count of conditional GitHub requests by result (not_modified, modified, not_found)",
+	}, []string{"result"})
+	reg.MustRegister(p.GitHubConditionalRequests)
+
+	p.ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "The total count of config reloads by result (success, failure)",
+	}, []string{"result"})
+	reg.MustRegister(p.ConfigReloads)
+
 	p.DBLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "database_latency_seconds",
 		Help:    "The number of seconds it takes to execute a database call",
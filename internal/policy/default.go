@@ -0,0 +1,197 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+	"github.com/moensch/buildkite-github-token-server/internal/github"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+// destinationPermissions are the permissions which allow writing to branches or paths of a repository
+var destinationPermissions = []string{"contents", "pull_requests", "workflows"}
+
+// PipelineRepoResolver looks up the repository a Buildkite pipeline builds
+type PipelineRepoResolver interface {
+	GetPipelineRepo(organizationSlug string, pipelineSlug string) (string, error)
+}
+
+// GitOpsGetter reads the gitops.yaml of a repository, or the org-wide policy file if the repository has none.
+// Both return nil if the file does not exist.
+type GitOpsGetter interface {
+	GetGitOps(owner string, repo string) (*github.GitOps, error)
+	GetOrgGitOps(org string) (*github.OrgGitOps, error)
+}
+
+// Default implements the built-in access rules:
+//   - buildkite plugin repositories are always readable, but never writable
+//   - the repository associated with the pipeline is always accessible
+//   - other repositories must list the pipeline's repository in their gitops.yaml, or in the org-wide
+//     policy file if they have no gitops.yaml
+type Default struct {
+	Pipelines PipelineRepoResolver
+
+	// GitHub returns the client for a given GitHub host
+	GitHub func(host string) (GitOpsGetter, error)
+}
+
+// Evaluate implements Policy. The default policy always has an opinion.
+func (p *Default) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	logger := contextvalues.GetLogger(ctx)
+	requestedRepo := input.Repository
+	// checks collects the trace of rules which did not decide
+	checks := Decision{}
+
+	if strings.HasSuffix(requestedRepo.Repo, "-buildkite-plugin") {
+		// Always allow read access to buildkite plugin repos
+		logger.Info("permit access to buildkite plugin repo",
+			zap.String("repository", requestedRepo.HTTPS()),
+		)
+		decision := Allow("buildkite-plugin", "repository is a buildkite plugin, which is only readable")
+		decision.Permissions = input.Permissions.Cap(api.AccessLevelRead)
+		decision.step("buildkite-plugin", true, "repository name ends in -buildkite-plugin")
+		return decision, nil
+	}
+	checks.step("buildkite-plugin", false, "repository name does not end in -buildkite-plugin")
+
+	// Check if the requested repo is associated with this pipeline
+	repo, err := p.Pipelines.GetPipelineRepo(input.Claims.OrganizationSlug, input.Claims.PipelineSlug)
+	if err != nil {
+		return Decision{}, err
+	}
+	buildkitePipelineRepo, err := repoparser.ExtractOrgRepoFromURL(repo)
+	if err != nil {
+		return Decision{}, fmt.Errorf("cannot parse repo %s: %s", repo, err)
+	}
+
+	if buildkitePipelineRepo.Equals(requestedRepo) {
+		// Requested repo matches repo associated with pipeline that issued the token
+		logger.Info("permit access to repo associated with pipeline",
+			zap.String("repository", requestedRepo.HTTPS()),
+		)
+		decision := Allow("pipeline-repository", "repository is associated with the pipeline")
+		decision.Trace = checks.Trace
+		decision.step("pipeline-repository", true, fmt.Sprintf("pipeline %s/%s builds %s",
+			input.Claims.OrganizationSlug, input.Claims.PipelineSlug, buildkitePipelineRepo.HTTPS()))
+		return decision, nil
+	}
+	checks.step("pipeline-repository", false, fmt.Sprintf("pipeline %s/%s builds %s",
+		input.Claims.OrganizationSlug, input.Claims.PipelineSlug, buildkitePipelineRepo.HTTPS()))
+
+	// Do we have a github client for this git host?
+	client, err := p.GitHub(requestedRepo.Host)
+	if err != nil {
+		return Decision{}, err
+	}
+	// Check if the requested repo has a gitops.yaml file pointing back to our origin repo
+	gitops, err := client.GetGitOps(requestedRepo.Org, requestedRepo.Repo)
+	if decision, denied := denyUnprotected("gitops", err, checks); denied {
+		return decision, nil
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+	// rule and source name where the rules granting access come from, for decisions and their reasons
+	rule, source := "gitops", "gitops.yaml"
+	if gitops != nil && gitops.Source != "" {
+		source = gitops.Source
+	}
+	if gitops == nil {
+		checks.step("gitops", false, "repository has no gitops.yaml")
+
+		// Fall back to the org-wide policy file
+		orgGitOps, err := client.GetOrgGitOps(requestedRepo.Org)
+		if decision, denied := denyUnprotected("org-gitops", err, checks); denied {
+			return decision, nil
+		}
+		if err != nil {
+			return Decision{}, err
+		}
+		if orgGitOps != nil {
+			gitops = orgGitOps.For(requestedRepo)
+			rule, source = "org-gitops", orgGitOps.Source
+			if gitops == nil {
+				checks.step(rule, false, fmt.Sprintf("no policy in %s targets the repository", source))
+			}
+		}
+	}
+	if gitops == nil {
+		// Neither the repo nor its org grant access, deny access
+		logger.Info("deny access to repo without gitops.yaml",
+			zap.String("repository", requestedRepo.HTTPS()),
+		)
+		reason := "repository has no gitops.yaml"
+		if rule == "org-gitops" {
+			reason = fmt.Sprintf("repository has no gitops.yaml and no policy in %s targets it", source)
+		}
+		decision := Deny(rule, reason)
+		decision.Trace = checks.Trace
+		return decision, nil
+	}
+
+	// Deny if the repo associated with the pipeline that made the request
+	// is not listed as permitted in the requested repo
+	permitted, listed := gitops.PermittedPermissions(buildkitePipelineRepo, input.Claims, input.Permissions)
+	gitopsStep := api.TraceStep{
+		Rule:          rule,
+		Matched:       listed,
+		Detail:        fmt.Sprintf("%s found, comparing its repos entries with %s", source, buildkitePipelineRepo.HTTPS()),
+		GitOpsEntries: gitops.Trace(buildkitePipelineRepo, input.Claims),
+	}
+	if !listed {
+		reason := fmt.Sprintf("%s does not list %s", source, buildkitePipelineRepo.HTTPS())
+		if gitops.RepositoryPermitted(buildkitePipelineRepo) {
+			reason = fmt.Sprintf("%s lists %s, but its conditions do not match this build", source, buildkitePipelineRepo.HTTPS())
+		}
+		logger.Info("deny access per gitops.yaml",
+			zap.String("repository", requestedRepo.HTTPS()),
+			zap.String("pipeline_repository", buildkitePipelineRepo.HTTPS()),
+			zap.String("reason", reason),
+		)
+		decision := Deny(rule, reason)
+		decision.Trace = append(checks.Trace, gitopsStep)
+		return decision, nil
+	}
+	decision := Allow(rule, fmt.Sprintf("%s lists %s", source, buildkitePipelineRepo.HTTPS()))
+	decision.Permissions = permitted
+	decision.Trace = append(checks.Trace, gitopsStep)
+
+	// Repos with protected destinations never receive write access from other repositories
+	if len(gitops.ProtectedDestinations) > 0 {
+		for _, name := range destinationPermissions {
+			if level, ok := decision.Permissions[name]; ok && level.Includes(api.AccessLevelWrite) {
+				decision.Permissions[name] = api.AccessLevelRead
+				decision.Rule = "gitops-protected-destinations"
+				decision.Reason = fmt.Sprintf("%s lists %s but protects %s, write access is not permitted from other repositories",
+					source, buildkitePipelineRepo.HTTPS(), strings.Join(gitops.ProtectedDestinations, ", "))
+			}
+		}
+		decision.step("gitops-protected-destinations", decision.Rule == "gitops-protected-destinations",
+			fmt.Sprintf("%s protects %s", source, strings.Join(gitops.ProtectedDestinations, ", ")))
+	}
+
+	logger.Info("permit access per gitops.yaml",
+		zap.String("repository", requestedRepo.HTTPS()),
+		zap.Any("permissions", decision.Permissions),
+		zap.String("reason", decision.Reason),
+	)
+	return decision, nil
+}
+
+// denyUnprotected turns the refusal to read gitops files from an unprotected default branch into a denial
+func denyUnprotected(rule string, err error, checks Decision) (Decision, bool) {
+	var unprotected *github.UnprotectedBranchError
+	if !errors.As(err, &unprotected) {
+		return Decision{}, false
+	}
+	decision := Deny(rule, unprotected.Error())
+	decision.Trace = checks.Trace
+	decision.step(rule, false, unprotected.Error())
+	return decision, true
+}
@@ -0,0 +1,134 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+	"github.com/moensch/buildkite-github-token-server/internal/github"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+type fakePipelines map[string]string
+
+func (f fakePipelines) GetPipelineRepo(organizationSlug string, pipelineSlug string) (string, error) {
+	repo, ok := f[fmt.Sprintf("%s/%s", organizationSlug, pipelineSlug)]
+	if !ok {
+		return "", fmt.Errorf("pipeline %s/%s not found", organizationSlug, pipelineSlug)
+	}
+	return repo, nil
+}
+
+// fakeGitOps holds gitops files by "<owner>/<repo>". unprotectedBranch stands for a repository whose gitops
+// files are refused by the ref policy.
+type fakeGitOps map[string]string
+
+const unprotectedBranch = "<unprotected>"
+
+func (f fakeGitOps) GetGitOps(owner string, repo string) (*github.GitOps, error) {
+	contents, ok := f[fmt.Sprintf("%s/%s", owner, repo)]
+	if !ok {
+		return nil, nil
+	}
+	if contents == unprotectedBranch {
+		return nil, &github.UnprotectedBranchError{Owner: owner, Repo: repo, Branch: "main"}
+	}
+	gitops, err := github.GitOpsFromString(contents)
+	return &gitops, err
+}
+
+// GetOrgGitOps reads the org policy file from the "<org>/.github" key
+func (f fakeGitOps) GetOrgGitOps(org string) (*github.OrgGitOps, error) {
+	contents, ok := f[fmt.Sprintf("%s/.github", org)]
+	if !ok {
+		return nil, nil
+	}
+	if contents == unprotectedBranch {
+		return nil, &github.UnprotectedBranchError{Owner: org, Repo: ".github", Branch: "main"}
+	}
+	orgGitOps, err := github.OrgGitOpsFromString(contents)
+	orgGitOps.Source = fmt.Sprintf("%s/.github/gitops.yaml", org)
+	return &orgGitOps, err
+}
+
+func TestDefaultEvaluate(t *testing.T) {
+	ctx := contextvalues.SetLogger(context.Background(), zap.NewNop())
+	p := &Default{
+		Pipelines: fakePipelines{"myorg/deployer": "https://github.com/myorg/deployer.git"},
+		GitHub: func(host string) (GitOpsGetter, error) {
+			return fakeGitOps{
+				"myorg/service":     "repos:\n  - github.com/myorg/deployer\n",
+				"myorg/protected":   "protectedDestinations: [main]\nrepos:\n  - repo: github.com/myorg/deploy*\n    branches: [main]\n",
+				"myorg/unprotected": unprotectedBranch,
+				"thirdorg/.github":  unprotectedBranch,
+				"otherorg/.github":  "policies:\n  - targets: [\"github.com/otherorg/service-*\", \"!github.com/otherorg/service-legacy\"]\n    repos:\n      - github.com/myorg/deployer\n",
+			}, nil
+		},
+	}
+	claims := buildkite.Claims{OrganizationSlug: "myorg", PipelineSlug: "deployer", BuildBranch: "main"}
+	writePermissions := api.Permissions{"metadata": api.AccessLevelRead, "contents": api.AccessLevelWrite}
+
+	tests := []struct {
+		name      string
+		repo      string
+		claims    buildkite.Claims
+		effect    Effect
+		rule      string
+		traceLen  int
+		lastMatch bool
+	}{
+		{name: "plugin", repo: "myorg/docker-buildkite-plugin", claims: claims, effect: EffectAllow, rule: "buildkite-plugin", traceLen: 1, lastMatch: true},
+		{name: "pipelineRepo", repo: "myorg/deployer", claims: claims, effect: EffectAllow, rule: "pipeline-repository", traceLen: 2, lastMatch: true},
+		{name: "noGitOps", repo: "myorg/other", claims: claims, effect: EffectDeny, rule: "gitops", traceLen: 3, lastMatch: false},
+		{name: "gitOpsListed", repo: "myorg/service", claims: claims, effect: EffectAllow, rule: "gitops", traceLen: 3, lastMatch: true},
+		{name: "protected", repo: "myorg/protected", claims: claims, effect: EffectAllow, rule: "gitops-protected-destinations", traceLen: 4, lastMatch: true},
+		{name: "orgGitOps", repo: "otherorg/service-api", claims: claims, effect: EffectAllow, rule: "org-gitops", traceLen: 4, lastMatch: true},
+		{name: "unprotectedBranch", repo: "myorg/unprotected", claims: claims, effect: EffectDeny, rule: "gitops", traceLen: 3, lastMatch: false},
+		{name: "orgGitOpsUnprotectedBranch", repo: "thirdorg/service", claims: claims, effect: EffectDeny, rule: "org-gitops", traceLen: 4, lastMatch: false},
+		{name: "orgGitOpsExcluded", repo: "otherorg/service-legacy", claims: claims, effect: EffectDeny, rule: "org-gitops", traceLen: 4, lastMatch: false},
+		{
+			name:      "conditionsMismatch",
+			repo:      "myorg/protected",
+			claims:    buildkite.Claims{OrganizationSlug: "myorg", PipelineSlug: "deployer", BuildBranch: "feature"},
+			effect:    EffectDeny,
+			rule:      "gitops",
+			traceLen:  3,
+			lastMatch: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := repoparser.ExtractOrgRepoFromURL(fmt.Sprintf("github.com/%s", tt.repo))
+			require.NoError(t, err)
+			decision, err := p.Evaluate(ctx, Input{Claims: tt.claims, Repository: repo, Permissions: writePermissions})
+			require.NoError(t, err)
+			assert.Equal(t, tt.effect, decision.Effect)
+			assert.Equal(t, tt.rule, decision.Rule)
+			require.Len(t, decision.Trace, tt.traceLen)
+			assert.Equal(t, tt.lastMatch, decision.Trace[len(decision.Trace)-1].Matched)
+		})
+	}
+
+	t.Run("pluginReadOnly", func(t *testing.T) {
+		repo := repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "docker-buildkite-plugin"}
+		decision, err := p.Evaluate(ctx, Input{Claims: claims, Repository: repo, Permissions: writePermissions})
+		require.NoError(t, err)
+		assert.Equal(t, api.Permissions{"metadata": api.AccessLevelRead, "contents": api.AccessLevelRead}, decision.Permissions)
+	})
+
+	t.Run("gitOpsEntries", func(t *testing.T) {
+		repo := repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "protected"}
+		decision, err := p.Evaluate(ctx, Input{Claims: claims, Repository: repo, Permissions: writePermissions})
+		require.NoError(t, err)
+		assert.Equal(t, []api.GitOpsEntryTrace{
+			{Repository: "github.com/myorg/deploy*", Access: api.AccessLevelWrite, RepositoryMatches: true, ConditionsMatch: true},
+		}, decision.Trace[2].GitOpsEntries)
+	})
+}
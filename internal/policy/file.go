@@ -0,0 +1,156 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+// File is a policy made of rules loaded from a YAML file. Rules are evaluated in order and the
+// first matching rule decides. If no rule matches, File has no opinion.
+//
+//	rules:
+//	  - name: no-writes-from-untrusted-queue
+//	    effect: deny
+//	    reason: untrusted agents only get read access
+//	    queues: ["untrusted"]
+//	    access: write
+//	  - name: deployer-reads-everything
+//	    effect: allow
+//	    organizations: ["myorg"]
+//	    pipelines: ["deploy-*"]
+//	    repositories: ["github.com/myorg/*", "!github.com/myorg/legacy-*"]
+//	    branches: ["main"]
+//	    buildSources: ["webhook", "ui"]
+//	    permissions:
+//	      contents: read
+type File struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule is a single allow or deny rule. Empty conditions match anything, all conditions must match.
+type Rule struct {
+	Name   string `yaml:"name"`
+	Effect Effect `yaml:"effect"`
+	Reason string `yaml:"reason"`
+
+	// ClaimConditions restrict the rule to builds with matching OIDC claims
+	buildkite.ClaimConditions `yaml:",inline"`
+
+	// Repositories are glob-style repository names matched against the requested repository,
+	// "!" negates a pattern, e.g. ["github.com/myorg/*", "!github.com/myorg/legacy-*"]
+	Repositories []string `yaml:"repositories"`
+
+	// Access makes the rule only match if any requested permission is at least this level
+	Access api.AccessLevel `yaml:"access"`
+
+	// Permissions limits what an allow rule grants
+	Permissions api.Permissions `yaml:"permissions"`
+
+	repositories []repoparser.RepositoryPattern
+}
+
+// NewFileFromPath loads a policy file from disk
+func NewFileFromPath(path string) (*File, error) {
+	filename, _ := filepath.Abs(path)
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file %s: %w", filename, err)
+	}
+	return NewFileFromString(string(contents))
+}
+
+// NewFileFromString parses a policy file and compiles all of its rules
+func NewFileFromString(contents string) (*File, error) {
+	f := &File{}
+	if err := yaml.UnmarshalStrict([]byte(contents), f); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file: %w", err)
+	}
+	for idx, rule := range f.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", idx)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %w", rule.Name, err)
+		}
+	}
+	return f, nil
+}
+
+func (r *Rule) compile() (err error) {
+	if r.Effect != EffectAllow && r.Effect != EffectDeny {
+		return fmt.Errorf("effect must be allow or deny, not '%s'", r.Effect)
+	}
+	if r.Access != "" && !r.Access.Valid() {
+		return fmt.Errorf("invalid access %s", r.Access)
+	}
+	if err = r.Permissions.Validate(); err != nil {
+		return err
+	}
+	if err = r.ClaimConditions.Compile(); err != nil {
+		return err
+	}
+	r.repositories = make([]repoparser.RepositoryPattern, len(r.Repositories))
+	for idx, repoString := range r.Repositories {
+		repo, err := repoparser.ParsePattern(repoString)
+		if err != nil {
+			return fmt.Errorf("cannot parse repo %s: %w", repoString, err)
+		}
+		r.repositories[idx] = repo
+	}
+	return nil
+}
+
+// Matches returns true if all of the rule's conditions match the input
+func (r *Rule) Matches(input Input) bool {
+	if !r.ClaimConditions.Matches(input.Claims) {
+		return false
+	}
+
+	if len(r.repositories) > 0 && !repoparser.MatchesAny(r.repositories, input.Repository) {
+		return false
+	}
+
+	if r.Access != "" && !input.Permissions.Highest().Includes(r.Access) {
+		return false
+	}
+	return true
+}
+
+// Evaluate implements Policy
+func (f *File) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	for _, rule := range f.Rules {
+		if !rule.Matches(input) {
+			continue
+		}
+
+		reason := rule.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("policy rule %s", rule.Name)
+		}
+		decision := Decision{Effect: rule.Effect, Rule: rule.Name, Reason: reason}
+		decision.step(rule.Name, true, fmt.Sprintf("policy file rule %s matched: %s", rule.Name, reason))
+		if rule.Effect == EffectAllow && len(rule.Permissions) > 0 {
+			decision.Permissions = input.Permissions.Restrict(rule.Permissions)
+		}
+
+		contextvalues.GetLogger(ctx).Info("policy rule matched",
+			zap.String("repository", input.Repository.HTTPS()),
+			zap.String("rule", rule.Name),
+			zap.String("effect", string(rule.Effect)),
+		)
+		return decision, nil
+	}
+	decision := Decision{}
+	decision.step("policy-file", false, fmt.Sprintf("none of %d policy file rules matched", len(f.Rules)))
+	return decision, nil
+}
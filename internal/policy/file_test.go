@@ -0,0 +1,144 @@
+package policy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+const testPolicy = `
+rules:
+  - name: no-writes-from-untrusted-queue
+    effect: deny
+    reason: untrusted agents only get read access
+    queues: ["untrusted"]
+    access: write
+  - name: deployer-reads-everything
+    effect: allow
+    organizations: ["myorg"]
+    pipelines: ["deploy-*"]
+    repositories: ["github.com/myorg/*", "!github.com/myorg/legacy-*"]
+    branches: ["main"]
+    permissions:
+      contents: read
+`
+
+func TestFileEvaluate(t *testing.T) {
+	f, err := NewFileFromString(testPolicy)
+	require.NoError(t, err)
+	ctx := contextvalues.SetLogger(context.Background(), zap.NewNop())
+
+	readPermissions := api.Permissions{"metadata": api.AccessLevelRead, "contents": api.AccessLevelRead}
+	writePermissions := api.Permissions{"metadata": api.AccessLevelRead, "contents": api.AccessLevelWrite}
+	repo := repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"}
+
+	tests := []struct {
+		name   string
+		input  Input
+		effect Effect
+		rule   string
+	}{
+		{
+			name: "untrustedQueueWrite",
+			input: Input{
+				Claims:      buildkite.Claims{OrganizationSlug: "myorg", PipelineSlug: "deploy-prod", QueueKey: "untrusted"},
+				Repository:  repo,
+				Permissions: writePermissions,
+			},
+			effect: EffectDeny,
+			rule:   "no-writes-from-untrusted-queue",
+		},
+		{
+			name: "untrustedQueueRead",
+			input: Input{
+				Claims:      buildkite.Claims{OrganizationSlug: "otherorg", PipelineSlug: "deploy-prod", QueueKey: "untrusted"},
+				Repository:  repo,
+				Permissions: readPermissions,
+			},
+			effect: EffectNone,
+		},
+		{
+			name: "deployerOnMain",
+			input: Input{
+				Claims:      buildkite.Claims{OrganizationSlug: "myorg", PipelineSlug: "deploy-prod", BuildBranch: "main"},
+				Repository:  repo,
+				Permissions: writePermissions,
+			},
+			effect: EffectAllow,
+			rule:   "deployer-reads-everything",
+		},
+		{
+			name: "deployerOnFeatureBranch",
+			input: Input{
+				Claims:      buildkite.Claims{OrganizationSlug: "myorg", PipelineSlug: "deploy-prod", BuildBranch: "feature"},
+				Repository:  repo,
+				Permissions: writePermissions,
+			},
+			effect: EffectNone,
+		},
+		{
+			name: "deployerExcludedRepo",
+			input: Input{
+				Claims:      buildkite.Claims{OrganizationSlug: "myorg", PipelineSlug: "deploy-prod", BuildBranch: "main"},
+				Repository:  repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "legacy-billing"},
+				Permissions: readPermissions,
+			},
+			effect: EffectNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := f.Evaluate(ctx, tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.effect, decision.Effect)
+			assert.Equal(t, tt.rule, decision.Rule)
+		})
+	}
+
+	t.Run("allowLimitsPermissions", func(t *testing.T) {
+		decision, err := f.Evaluate(ctx, tests[2].input)
+		require.NoError(t, err)
+		assert.Equal(t, readPermissions, decision.Permissions)
+	})
+}
+
+func TestNewFileFromString(t *testing.T) {
+	t.Run("invalidEffect", func(t *testing.T) {
+		_, err := NewFileFromString("rules:\n  - name: foo\n    effect: maybe\n")
+		require.Error(t, err)
+	})
+	t.Run("invalidGlob", func(t *testing.T) {
+		_, err := NewFileFromString("rules:\n  - name: foo\n    effect: deny\n    pipelines: [\"[\"]\n")
+		require.Error(t, err)
+	})
+	t.Run("unknownKey", func(t *testing.T) {
+		_, err := NewFileFromString("rules:\n  - name: foo\n    effect: deny\n    pipeline: [\"foo\"]\n")
+		require.Error(t, err)
+	})
+}
+
+func TestChainEvaluate(t *testing.T) {
+	f, err := NewFileFromString(testPolicy)
+	require.NoError(t, err)
+	ctx := contextvalues.SetLogger(context.Background(), zap.NewNop())
+
+	decision, err := Chain{f}.Evaluate(ctx, Input{
+		Claims:     buildkite.Claims{OrganizationSlug: "otherorg"},
+		Repository: repoparser.RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"},
+	})
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "default", decision.Rule)
+	require.Len(t, decision.Trace, 2)
+	assert.Equal(t, "policy-file", decision.Trace[0].Rule)
+	assert.False(t, decision.Trace[0].Matched)
+	assert.Equal(t, "default", decision.Trace[1].Rule)
+}
@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"context"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+)
+
+// Input is everything a policy can base its decision for a single repository on
+type Input struct {
+	// Claims are the verified claims of the Buildkite OIDC token
+	Claims buildkite.Claims
+
+	// Repository is the repository access is requested for
+	Repository repoparser.RepositoryName
+
+	// Permissions are the requested GitHub permissions
+	Permissions api.Permissions
+}
+
+type Effect string
+
+const (
+	// EffectNone means the policy has no opinion and the next policy is consulted
+	EffectNone  Effect = ""
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Decision is the outcome of evaluating a policy for a single repository
+type Decision struct {
+	Effect Effect
+
+	// Rule names the rule which made the decision
+	Rule string
+
+	// Reason explains the decision in human readable form
+	Reason string
+
+	// Permissions is the highest set of permissions the repository allows out of the requested ones.
+	// nil means the requested permissions are not restricted.
+	Permissions api.Permissions
+
+	// Trace lists the checks which led to the decision, including those of policies without an opinion
+	Trace []api.TraceStep
+}
+
+// Allowed returns true if the decision permits access
+func (d Decision) Allowed() bool {
+	return d.Effect == EffectAllow
+}
+
+// Access returns the highest access level the decision allows
+func (d Decision) Access(requested api.Permissions) api.AccessLevel {
+	if !d.Allowed() {
+		return ""
+	}
+	if d.Permissions == nil {
+		return requested.Highest()
+	}
+	return d.Permissions.Highest()
+}
+
+// Allow returns a decision permitting access
+func Allow(rule string, reason string) Decision {
+	return Decision{Effect: EffectAllow, Rule: rule, Reason: reason}
+}
+
+// Deny returns a decision refusing access
+func Deny(rule string, reason string) Decision {
+	return Decision{Effect: EffectDeny, Rule: rule, Reason: reason}
+}
+
+// Policy decides whether a pipeline may access a repository
+type Policy interface {
+	// Evaluate returns a decision with EffectNone if the policy has no opinion on the input
+	Evaluate(ctx context.Context, input Input) (Decision, error)
+}
+
+// Chain evaluates policies in order. The first policy with an opinion decides.
+type Chain []Policy
+
+// Evaluate implements Policy. It denies access if no policy in the chain has an opinion.
+func (c Chain) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	var trace []api.TraceStep
+	for _, p := range c {
+		decision, err := p.Evaluate(ctx, input)
+		if err != nil {
+			return Decision{}, err
+		}
+		trace = append(trace, decision.Trace...)
+		if decision.Effect != EffectNone {
+			decision.Trace = trace
+			return decision, nil
+		}
+	}
+	decision := Deny("default", "no policy permits access")
+	decision.Trace = append(trace, api.TraceStep{Rule: "default", Matched: true, Detail: decision.Reason})
+	return decision, nil
+}
+
+// step records a check in the decision's trace
+func (d *Decision) step(rule string, matched bool, detail string) {
+	d.Trace = append(d.Trace, api.TraceStep{Rule: rule, Matched: matched, Detail: detail})
+}
@@ -0,0 +1,27 @@
+package repoparser
+
+import "fmt"
+
+// RepositoryGroup is a set of repositories in the same host and org
+type RepositoryGroup struct {
+	Host         string
+	Org          string
+	Repositories []RepositoryName
+}
+
+// GroupByOrg groups repositories by host and org, preserving the order in which each group was first seen
+func GroupByOrg(repos []RepositoryName) []*RepositoryGroup {
+	groups := make([]*RepositoryGroup, 0)
+	index := make(map[string]*RepositoryGroup)
+	for _, repo := range repos {
+		key := fmt.Sprintf("%s/%s", repo.Host, repo.Org)
+		group, ok := index[key]
+		if !ok {
+			group = &RepositoryGroup{Host: repo.Host, Org: repo.Org}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.Repositories = append(group.Repositories, repo)
+	}
+	return groups
+}
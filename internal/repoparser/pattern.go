@@ -0,0 +1,81 @@
+package repoparser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// RepositoryPattern is a compiled glob-style repository definition such as github.com/myorg/* or
+// *.corp.example.com/myorg/service. A leading "!" negates the pattern, see MatchesAny.
+type RepositoryPattern struct {
+	// RepositoryName holds the host, org and repo glob patterns as written
+	RepositoryName
+
+	// Negated patterns exclude the repositories they match
+	Negated bool
+
+	host, org, repo glob.Glob
+}
+
+// ParsePattern parses and compiles a repository pattern. It accepts the same forms as ExtractOrgRepoFromURL,
+// with glob patterns in the host, org and repo parts.
+func ParsePattern(pattern string) (RepositoryPattern, error) {
+	p := RepositoryPattern{}
+	if strings.HasPrefix(pattern, "!") {
+		p.Negated = true
+		pattern = strings.TrimPrefix(pattern, "!")
+	}
+
+	repo, err := ExtractOrgRepoFromURL(pattern)
+	if err != nil {
+		return p, err
+	}
+	p.RepositoryName = repo
+
+	// "*" does not match across dots in host names, so github.* cannot match github.evil.com
+	if p.host, err = glob.Compile(repo.Host, '.'); err != nil {
+		return p, fmt.Errorf("invalid host pattern '%s': %w", repo.Host, err)
+	}
+	if p.org, err = glob.Compile(repo.Org); err != nil {
+		return p, fmt.Errorf("invalid org pattern '%s': %w", repo.Org, err)
+	}
+	if p.repo, err = glob.Compile(repo.Repo); err != nil {
+		return p, fmt.Errorf("invalid repo pattern '%s': %w", repo.Repo, err)
+	}
+	return p, nil
+}
+
+// String returns the pattern as host/org/repo, prefixed by "!" if it is negated
+func (p RepositoryPattern) String() string {
+	s := fmt.Sprintf("%s/%s/%s", p.Host, p.Org, p.Repo)
+	if p.Negated {
+		return "!" + s
+	}
+	return s
+}
+
+// Matches returns true if the glob patterns match a repository, regardless of whether the pattern is negated
+func (p RepositoryPattern) Matches(repo RepositoryName) bool {
+	if p.host == nil || p.org == nil || p.repo == nil {
+		// not compiled through ParsePattern
+		return false
+	}
+	return p.host.Match(repo.Host) && p.org.Match(repo.Org) && p.repo.Match(repo.Repo)
+}
+
+// MatchesAny returns true if a repository matches at least one pattern and none of the negated patterns
+func MatchesAny(patterns []RepositoryPattern, repo RepositoryName) bool {
+	matched := false
+	for _, p := range patterns {
+		if !p.Matches(repo) {
+			continue
+		}
+		if p.Negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
@@ -0,0 +1,96 @@
+package repoparser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    string
+		negated bool
+		wantErr bool
+	}{
+		{name: "plain", pattern: "github.com/myorg/service", want: "github.com/myorg/service"},
+		{name: "https", pattern: "https://github.com/myorg/service.git", want: "github.com/myorg/service"},
+		{name: "hostGlob", pattern: "*.corp.example.com/myorg/*", want: "*.corp.example.com/myorg/*"},
+		{name: "negated", pattern: "!myorg/legacy-*", want: "!github.com/myorg/legacy-*", negated: true},
+		{name: "invalidRepoGlob", pattern: "github.com/myorg/legacy[", wantErr: true},
+		{name: "invalidRepo", pattern: "notarepo", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePattern(tt.pattern)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, p.String())
+			assert.Equal(t, tt.negated, p.Negated)
+		})
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	parse := func(patterns ...string) []RepositoryPattern {
+		parsed := make([]RepositoryPattern, len(patterns))
+		for idx, pattern := range patterns {
+			p, err := ParsePattern(pattern)
+			require.NoError(t, err)
+			parsed[idx] = p
+		}
+		return parsed
+	}
+	patterns := parse("github.com/myorg/*", "!github.com/myorg/legacy-*", "ghe-*.corp/platform/*")
+
+	tests := []struct {
+		name string
+		repo RepositoryName
+		want bool
+	}{
+		{name: "orgGlob", repo: RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"}, want: true},
+		{name: "negated", repo: RepositoryName{Host: "github.com", Org: "myorg", Repo: "legacy-billing"}, want: false},
+		{name: "otherOrg", repo: RepositoryName{Host: "github.com", Org: "otherorg", Repo: "service"}, want: false},
+		{name: "hostGlob", repo: RepositoryName{Host: "ghe-east.corp", Org: "platform", Repo: "infra"}, want: true},
+		{name: "hostGlobStopsAtDots", repo: RepositoryName{Host: "ghe-east.evil.corp", Org: "platform", Repo: "infra"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, MatchesAny(patterns, tt.repo))
+		})
+	}
+
+	assert.False(t, MatchesAny(parse("!github.com/myorg/legacy-*"), RepositoryName{Host: "github.com", Org: "myorg", Repo: "service"}),
+		"negated patterns alone match nothing")
+}
+
+func TestRepositoryPattern_Matches(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		repo    RepositoryName
+		want    bool
+	}{
+		{name: "wildcard-match", pattern: "github.com/*/*", repo: RepositoryName{Host: "github.com", Org: "foobar", Repo: "baz"}, want: true},
+		{name: "host-wildcard-stops-at-dots", pattern: "*/*/*", repo: RepositoryName{Host: "randomhost.com", Org: "foobar", Repo: "baz"}, want: false},
+		{name: "host-mismatch", pattern: "github.com/*/*", repo: RepositoryName{Host: "foobargithub.com", Org: "foobar", Repo: "baz"}, want: false},
+		{name: "wildcard-match-repo", pattern: "github.com/twilio/*", repo: RepositoryName{Host: "github.com", Org: "twilio", Repo: "baz"}, want: true},
+		{name: "wildcard-match-repo-partial", pattern: "github.com/twilio/some-*", repo: RepositoryName{Host: "github.com", Org: "twilio", Repo: "some-thing"}, want: true},
+		{name: "wildcard-mismatch-repo-partial", pattern: "github.com/twilio/some-*", repo: RepositoryName{Host: "github.com", Org: "twilio", Repo: "other-thing"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePattern(tt.pattern)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, p.Matches(tt.repo))
+		})
+	}
+
+	assert.False(t, RepositoryPattern{RepositoryName: RepositoryName{Host: "github.com", Org: "*", Repo: "*"}}.Matches(RepositoryName{Host: "github.com", Org: "foobar", Repo: "baz"}),
+		"patterns not compiled through ParsePattern match nothing")
+}
@@ -5,7 +5,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/gobwas/glob"
 	giturls "github.com/whilp/git-urls"
 )
 
@@ -39,34 +38,6 @@ func (r RepositoryName) Equals(repo RepositoryName) bool {
 	return r.Host == repo.Host && r.Org == repo.Org && r.Repo == repo.Repo
 }
 
-// Matches returns true if the provided repository matches a glob-style repo definition
-func (r RepositoryName) Matches(repo RepositoryName) bool {
-	if r.Host != repo.Host {
-		// No glob match on host, sorry
-		return false
-	}
-
-	g, err := glob.Compile(r.Org)
-	if err != nil {
-		// ignore errors for now
-		return false
-	}
-	if !g.Match(repo.Org) {
-		return false
-	}
-
-	g, err = glob.Compile(r.Repo)
-	if err != nil {
-		// ignore errors for now
-		return false
-	}
-	if !g.Match(repo.Repo) {
-		return false
-	}
-
-	return true
-}
-
 // ExtractOrgRepoFromURL returns the GitHub org and repo string from nearly any GitHub URL
 func ExtractOrgRepoFromURL(githubURL string) (RepositoryName, error) {
 	ret := RepositoryName{}
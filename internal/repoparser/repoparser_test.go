@@ -151,72 +151,6 @@ func TestExtractOrgRepoFromURL(t *testing.T) {
 	}
 }
 
-func TestRepositoryName_Matches(t *testing.T) {
-	type fields struct {
-		Host string
-		Org  string
-		Repo string
-	}
-	type args struct {
-		repo RepositoryName
-	}
-	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   bool
-	}{
-		{
-			name:   "wildcard-match",
-			fields: fields{Host: "github.com", Org: "*", Repo: "*"},
-			args:   args{repo: RepositoryName{Host: "github.com", Org: "foobar", Repo: "baz"}},
-			want:   true,
-		},
-		{
-			name:   "disallow-host-wildcard",
-			fields: fields{Host: "*", Org: "*", Repo: "*"},
-			args:   args{repo: RepositoryName{Host: "randomhost.com", Org: "foobar", Repo: "baz"}},
-			want:   false,
-		},
-		{
-			name:   "host-mismatch",
-			fields: fields{Host: "github.com", Org: "*", Repo: "*"},
-			args:   args{repo: RepositoryName{Host: "foobargithub.com", Org: "foobar", Repo: "baz"}},
-			want:   false,
-		},
-		{
-			name:   "wildcard-match-repo",
-			fields: fields{Host: "github.com", Org: "twilio", Repo: "*"},
-			args:   args{repo: RepositoryName{Host: "github.com", Org: "twilio", Repo: "baz"}},
-			want:   true,
-		},
-		{
-			name:   "wildcard-match-repo-partial",
-			fields: fields{Host: "github.com", Org: "twilio", Repo: "some-*"},
-			args:   args{repo: RepositoryName{Host: "github.com", Org: "twilio", Repo: "some-thing"}},
-			want:   true,
-		},
-		{
-			name:   "wildcard-mismatch-repo-partial",
-			fields: fields{Host: "github.com", Org: "twilio", Repo: "some-*"},
-			args:   args{repo: RepositoryName{Host: "github.com", Org: "twilio", Repo: "other-thing"}},
-			want:   false,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			r := RepositoryName{
-				Host: tt.fields.Host,
-				Org:  tt.fields.Org,
-				Repo: tt.fields.Repo,
-			}
-			if got := r.Matches(tt.args.repo); got != tt.want {
-				t.Errorf("RepositoryName.Matches() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func TestRepositoryName_Equals(t *testing.T) {
 	type fields struct {
 		Host string
@@ -264,3 +198,17 @@ func TestRepositoryName_Equals(t *testing.T) {
 		})
 	}
 }
+
+func TestGroupByOrg(t *testing.T) {
+	repos := []RepositoryName{
+		{Host: "github.com", Org: "myorg", Repo: "a"},
+		{Host: "ghes.mycompany.com", Org: "myorg", Repo: "b"},
+		{Host: "github.com", Org: "otherorg", Repo: "c"},
+		{Host: "github.com", Org: "myorg", Repo: "d"},
+	}
+	groups := GroupByOrg(repos)
+	require.Len(t, groups, 3)
+	assert.Equal(t, &RepositoryGroup{Host: "github.com", Org: "myorg", Repositories: []RepositoryName{repos[0], repos[3]}}, groups[0])
+	assert.Equal(t, &RepositoryGroup{Host: "ghes.mycompany.com", Org: "myorg", Repositories: []RepositoryName{repos[1]}}, groups[1])
+	assert.Equal(t, &RepositoryGroup{Host: "github.com", Org: "otherorg", Repositories: []RepositoryName{repos[2]}}, groups[2])
+}
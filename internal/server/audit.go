@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/audit"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+)
+
+type auditCtxKey struct{}
+
+// auditMiddleware writes an audit event for every request to next. Handlers add details to the event
+// returned by auditEvent, the outcome is derived from the response status unless the handler set it.
+func (srv *Server) auditMiddleware(eventType string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := &audit.Event{
+			Time:      time.Now().UTC(),
+			Type:      eventType,
+			RequestID: contextvalues.GetRequestID(r.Context()),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditCtxKey{}, event))
+
+		rec := writerRecorder{w, http.StatusOK, []byte{}}
+		defer func() {
+			// panics are answered with a 500 by middlewareRecoverer, audit them as such and pass them on
+			p := recover()
+			if p != nil {
+				rec.status = http.StatusInternalServerError
+				event.Outcome = audit.OutcomeError
+			}
+			srv.writeAuditEvent(r.Context(), event, rec.status)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next(&rec, r)
+	}
+}
+
+// writeAuditEvent completes the event with the response status and writes it to the audit sinks
+func (srv *Server) writeAuditEvent(ctx context.Context, event *audit.Event, status int) {
+	event.Status = status
+	if event.Outcome == "" {
+		switch {
+		case status >= 500:
+			event.Outcome = audit.OutcomeError
+		case status >= 400:
+			event.Outcome = audit.OutcomeDenied
+		}
+	}
+	if err := srv.audit.Write(event); err != nil {
+		contextvalues.GetLogger(ctx).Error("cannot write audit event", zap.Error(err))
+	}
+}
+
+// auditEvent returns the audit event of the request, or a throwaway event if the request is not audited
+func auditEvent(ctx context.Context) *audit.Event {
+	if event, ok := ctx.Value(auditCtxKey{}).(*audit.Event); ok {
+		return event
+	}
+	return &audit.Event{}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+	"github.com/moensch/buildkite-github-token-server/internal/policy"
+)
+
+// tokenDecision is the outcome of the checks of a token request
+type tokenDecision struct {
+	// Repositories holds the decision and trace of every repository checked, in the order requested
+	Repositories []api.RepositoryExplanation
+
+	// Refusal is the first reason the request is refused for, empty if a token may be issued. Status is the
+	// HTTP status /token refuses the request with.
+	Refusal string
+	Status  int
+
+	// Permissions are the permissions a token is issued with, lowered by repositories which grant less if the
+	// request allows downgrades
+	Permissions api.Permissions
+}
+
+// refuse records a reason to refuse the request, keeping the first one
+func (d *tokenDecision) refuse(status int, reason string) {
+	if d.Refusal == "" {
+		d.Refusal = reason
+		d.Status = status
+	}
+}
+
+// decisions returns the decisions of the repositories checked
+func (d *tokenDecision) decisions() []api.RepositoryDecision {
+	var decisions []api.RepositoryDecision
+	for _, explanation := range d.Repositories {
+		decisions = append(decisions, explanation.RepositoryDecision)
+	}
+	return decisions
+}
+
+// decide runs the checks of a token request, for both /token and /token/explain. Requests without repositories
+// are refused outright. Repositories the Buildkite organization may not access or no GitHub app is configured
+// for are refused before any policy makes API calls, followed by the permission ceiling and the policies of
+// every repository. Unless all is set, decide stops at the first refusal. Errors mean no decision could be made.
+func (srv *Server) decide(ctx context.Context, st *state, claims buildkite.Claims, orgConfig *config.ConfigOrganization, input api.TokenRequest, all bool) (tokenDecision, error) {
+	logger := contextvalues.GetLogger(ctx)
+	requestedPermissions := input.RequestedPermissions()
+	d := tokenDecision{Permissions: requestedPermissions}
+
+	// explanations are indexed like input.Repositories, nil for repositories not checked (yet)
+	explanations := make([]*api.RepositoryExplanation, len(input.Repositories))
+	done := func() tokenDecision {
+		for _, explanation := range explanations {
+			if explanation != nil {
+				d.Repositories = append(d.Repositories, *explanation)
+			}
+		}
+		return d
+	}
+
+	if len(input.Repositories) == 0 {
+		d.refuse(http.StatusBadRequest, "no repositories requested")
+		return done(), nil
+	}
+
+	for idx, repo := range input.Repositories {
+		var rule, reason string
+		var status int
+		if !orgConfig.GitHubOrgAllowed(repo.Host, repo.Org) {
+			rule, status = "organization-allowlist", http.StatusForbidden
+			reason = fmt.Sprintf("buildkite organization %s may not access %s/%s", claims.OrganizationSlug, repo.Host, repo.Org)
+		} else if _, ok := st.githubClient(repo.Host); !ok {
+			rule, status = "github-app", http.StatusBadRequest
+			reason = fmt.Sprintf("no github app configured for %s", repo.Host)
+		} else {
+			continue
+		}
+		explanations[idx] = &api.RepositoryExplanation{
+			RepositoryDecision: api.RepositoryDecision{Repository: repo.HTTPS(), Rule: rule, Reason: reason},
+			Trace:              []api.TraceStep{{Rule: rule, Detail: reason}},
+		}
+		d.refuse(status, reason)
+		if !all {
+			return done(), nil
+		}
+	}
+
+	if exceeding := requestedPermissions.Exceeding(st.config.Ceiling()); len(exceeding) > 0 {
+		d.refuse(http.StatusForbidden, fmt.Sprintf("requested permissions exceed what this server permits: %s", strings.Join(exceeding, ", ")))
+		if !all {
+			return done(), nil
+		}
+	}
+
+	for idx, repo := range input.Repositories {
+		if explanations[idx] != nil {
+			continue
+		}
+		decision, err := st.policy.Evaluate(ctx, policy.Input{
+			Claims:      claims,
+			Repository:  repo,
+			Permissions: requestedPermissions,
+		})
+		if err != nil {
+			return done(), err
+		}
+		explanations[idx] = &api.RepositoryExplanation{
+			RepositoryDecision: api.RepositoryDecision{
+				Repository:  repo.HTTPS(),
+				Allowed:     decision.Allowed(),
+				Access:      decision.Access(requestedPermissions),
+				Rule:        decision.Rule,
+				Reason:      decision.Reason,
+				Permissions: decision.Permissions,
+			},
+			Trace: decision.Trace,
+		}
+		if !decision.Allowed() {
+			d.refuse(http.StatusForbidden, fmt.Sprintf("not allowed to access repo %s: %s", repo.HTTPS(), decision.Reason))
+			if !all {
+				return done(), nil
+			}
+			continue
+		}
+		if decision.Permissions == nil {
+			continue
+		}
+		if exceeding := requestedPermissions.Exceeding(decision.Permissions); len(exceeding) > 0 {
+			if !input.AllowDowngrade {
+				d.refuse(http.StatusForbidden, fmt.Sprintf("repo %s does not grant %s: %s", repo.HTTPS(), strings.Join(exceeding, ", "), decision.Reason))
+				if !all {
+					return done(), nil
+				}
+				continue
+			}
+			logger.Info("downgrading permissions",
+				zap.String("repository", repo.HTTPS()),
+				zap.Strings("exceeding", exceeding),
+			)
+			d.Permissions = d.Permissions.Intersect(decision.Permissions)
+		}
+	}
+
+	// Intersect keeps metadata access, a downgrade may leave nothing else
+	if !d.Permissions.BeyondMetadata() && requestedPermissions.BeyondMetadata() {
+		d.refuse(http.StatusForbidden, "no permissions besides metadata left to grant after downgrade")
+	}
+	return done(), nil
+}
@@ -6,14 +6,16 @@ import (
 	"net/http"
 	"strings"
 
-	gogit "github.com/google/go-github/v48/github"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"go.uber.org/zap"
 
 	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/audit"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/config"
 	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
 	"github.com/moensch/buildkite-github-token-server/internal/github"
 	"github.com/moensch/buildkite-github-token-server/internal/repoparser"
+	"github.com/moensch/buildkite-github-token-server/internal/tokenregistry"
 )
 
 // handleToken reponds to /token requests
@@ -27,156 +29,282 @@ func (srv *Server) handleToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get keyset for JWT validation
-	keyset, err := srv.jwkCache.Get()
-	if err != nil {
-		srv.handleError(w, r, err, "", http.StatusInternalServerError)
-		return
-	}
-
-	requestToken := r.Header.Get("X-Buildkite-OIDC-Token")
-	splitToken := strings.Split(requestToken, "Bearer")
-	if len(splitToken) != 2 {
-		srv.handleError(w, r, nil, "invalid token", http.StatusForbidden)
+	st := srv.current()
+	claims, orgConfig, ok := srv.authenticate(w, r, st)
+	if !ok {
 		return
 	}
-
-	// parse the token, this validates:
-	//  * expiry
-	//  * not before
-	//  * audience
-	//  * issuer
-	verifiedToken, err := jwt.Parse([]byte(strings.TrimSpace(splitToken[1])), jwt.WithKeySet(keyset), jwt.WithAudience(jwtAudience), jwt.WithIssuer(jwtIssuer))
-	if err != nil {
-		srv.handleError(w, r, err, "cannot verify token", http.StatusForbidden)
-		return
+	event := auditEvent(r.Context())
+	for _, repo := range input.Repositories {
+		event.Repositories = append(event.Repositories, repo.HTTPS())
 	}
+	event.RequestedPermissions = input.RequestedPermissions()
 
-	// ensure custom claims are set
-	jobID, exists := verifiedToken.Get("job_id")
-	if !exists {
-		srv.handleError(w, r, nil, "missing job_id", http.StatusBadRequest)
-		return
-	}
-	organizationSlug, exists := verifiedToken.Get("organization_slug")
-	if !exists {
-		srv.handleError(w, r, nil, "missing organization_id", http.StatusBadRequest)
-		return
-	}
-	pipelineSlug, exists := verifiedToken.Get("pipeline_slug")
-	if !exists {
-		srv.handleError(w, r, nil, "missing pipeline_slug", http.StatusBadRequest)
-		return
-	}
 	repoStrings := make([]string, len(input.Repositories))
 	for i, r := range input.Repositories {
 		repoStrings[i] = r.HTTPS()
 	}
 
 	reqLogger := logger.With(
-		zap.String("job_id", jobID.(string)),
-		zap.String("organization_slug", organizationSlug.(string)),
-		zap.String("pipeline_slug", pipelineSlug.(string)),
+		zap.String("job_id", claims.JobID),
+		zap.String("organization_slug", claims.OrganizationSlug),
+		zap.String("pipeline_slug", claims.PipelineSlug),
+		zap.Int64("build_number", claims.BuildNumber),
+		zap.String("build_branch", claims.BuildBranch),
+		zap.String("build_source", claims.BuildSource),
+		zap.String("step_key", claims.StepKey),
 		zap.Strings("repositories", repoStrings),
 	)
+	ctx := contextvalues.SetLogger(r.Context(), reqLogger)
 	reqLogger.Info("processing token request",
 		zap.String("access_level", string(input.AccessLevel)),
+		zap.Any("permissions", input.Permissions),
 	)
 
-	for _, repo := range input.Repositories {
-		allow, err := srv.allowRepoAccess(reqLogger, organizationSlug.(string), pipelineSlug.(string), repo)
-		if err != nil {
-			srv.handleError(w, r, err, "error checking repository access", http.StatusInternalServerError)
+	// Ensure the requested permissions are known to GitHub
+	requestedPermissions := input.RequestedPermissions()
+	_, err = github.InstallationPermissions(requestedPermissions)
+	if err != nil {
+		srv.handleError(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decided, err := srv.decide(ctx, st, claims, orgConfig, input, false)
+	decisions := decided.decisions()
+	event.Decisions = decisions
+	if err != nil {
+		srv.handleError(w, r, err, "error checking repository access", http.StatusInternalServerError)
+		return
+	}
+	if decided.Refusal != "" {
+		srv.handleError(w, r, nil, decided.Refusal, decided.Status)
+		return
+	}
+	grantedPermissions := decided.Permissions
+
+	// Repos permitted, mint one token per GitHub host and org
+	permissions, err := github.InstallationPermissions(grantedPermissions)
+	if err != nil {
+		srv.handleError(w, r, err, "cannot prepare token permissions", http.StatusInternalServerError)
+		return
+	}
+	resp := api.TokenResponse{
+		Tokens:      make([]api.ScopedToken, 0),
+		RequestID:   contextvalues.GetRequestID(r.Context()),
+		Permissions: grantedPermissions,
+		Decisions:   decisions,
+	}
+	// issued are registered for revocation once all tokens were minted
+	issued := make([]tokenregistry.Token, 0)
+	for _, group := range repoparser.GroupByOrg(input.Repositories) {
+		client, ok := st.githubClient(group.Host)
+		if !ok {
+			// decide checked every host against st, so this is a bug rather than a bad request
+			srv.revokeUnused(reqLogger, st, claims.JobID, issued)
+			srv.handleError(w, r, nil, fmt.Sprintf("no github app configured for %s", group.Host), http.StatusInternalServerError)
 			return
 		}
-		if !allow {
-			srv.handleError(w, r, nil, fmt.Sprintf("not allowed to acccess repo %s", repo.HTTPS()), http.StatusForbidden)
+		token, err := client.CreateInstallationToken(group.Repositories, permissions)
+		if err != nil {
+			// the client gets no tokens, do not leave the ones minted for other orgs valid
+			srv.revokeUnused(reqLogger, st, claims.JobID, issued)
+			srv.handleError(w, r, err, fmt.Sprintf("cannot issue access token for %s/%s", group.Host, group.Org), http.StatusInternalServerError)
 			return
 		}
+		scoped := api.ScopedToken{
+			Token:        token.GetToken(),
+			ExpiresAt:    token.GetExpiresAt(),
+			Host:         group.Host,
+			Organization: group.Org,
+			Repositories: make([]string, len(group.Repositories)),
+		}
+		for idx, repo := range group.Repositories {
+			scoped.Repositories[idx] = repo.HTTPS()
+		}
+		resp.Tokens = append(resp.Tokens, scoped)
+		issued = append(issued, tokenregistry.Token{
+			Token:        scoped.Token,
+			Host:         scoped.Host,
+			Organization: scoped.Organization,
+			ExpiresAt:    scoped.ExpiresAt,
+		})
+		reqLogger.Info("issued token",
+			zap.String("host", group.Host),
+			zap.String("org", group.Org),
+			zap.Time("expires_at", scoped.ExpiresAt),
+			zap.Any("permissions", grantedPermissions),
+		)
+		event.Tokens = append(event.Tokens, audit.Token{
+			Host:         scoped.Host,
+			Organization: scoped.Organization,
+			Repositories: scoped.Repositories,
+			ExpiresAt:    scoped.ExpiresAt,
+			Fingerprint:  audit.Fingerprint(scoped.Token),
+		})
+	}
+	srv.tokens.Add(claims.JobID, issued...)
+	event.GrantedPermissions = grantedPermissions
+	event.Outcome = audit.OutcomeIssued
+	if len(resp.Tokens) == 1 {
+		// keep single-token responses compatible with older clients
+		resp.Token = resp.Tokens[0].Token
+		resp.ExpiresAt = resp.Tokens[0].ExpiresAt
 	}
 
-	// Repos permitted, mint the token
-	// TODO nasty
-	token, err := srv.githubAppClients[input.Repositories[0].Host].CreateInstallationToken(input.Repositories, &gogit.InstallationPermissions{
-		Metadata:     gogit.String("read"),
-		Contents:     gogit.String(string(input.AccessLevel)),
-		PullRequests: gogit.String(string(input.AccessLevel)),
-	})
+	jsonResp, err := json.Marshal(resp)
 	if err != nil {
-		srv.handleError(w, r, err, "cannot issue access token", http.StatusInternalServerError)
+		srv.handleError(w, r, err, "cannot parse response", http.StatusInternalServerError)
 		return
 	}
+	_, _ = w.Write(jsonResp)
+}
 
-	jsonResp, err := json.Marshal(api.TokenResponse{
-		Token:     token.GetToken(),
-		ExpiresAt: token.GetExpiresAt(),
-		RequestID: contextvalues.GetRequestID(r.Context()),
-	})
+// handleExplain responds to /token/explain requests. It runs the same checks as handleToken without issuing a
+// token and returns the trace of every repository decision.
+func (srv *Server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	var input api.TokenRequest
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		srv.handleError(w, r, err, "cannot read input", http.StatusBadRequest)
+		return
+	}
+
+	st := srv.current()
+	claims, orgConfig, ok := srv.authenticate(w, r, st)
+	if !ok {
+		return
+	}
+	reqLogger := contextvalues.GetLogger(r.Context()).With(
+		zap.String("job_id", claims.JobID),
+		zap.String("organization_slug", claims.OrganizationSlug),
+		zap.String("pipeline_slug", claims.PipelineSlug),
+		zap.Bool("explain", true),
+	)
+	ctx := contextvalues.SetLogger(r.Context(), reqLogger)
+
+	event := auditEvent(r.Context())
+	for _, repo := range input.Repositories {
+		event.Repositories = append(event.Repositories, repo.HTTPS())
+	}
+	requestedPermissions := input.RequestedPermissions()
+	event.RequestedPermissions = requestedPermissions
+
+	_, err = github.InstallationPermissions(requestedPermissions)
+	if err != nil {
+		srv.handleError(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decided, err := srv.decide(ctx, st, claims, orgConfig, input, true)
+	event.Decisions = decided.decisions()
+	if err != nil {
+		srv.handleError(w, r, err, "error checking repository access", http.StatusInternalServerError)
+		return
+	}
+	resp := api.ExplainResponse{
+		Allowed:      decided.Refusal == "",
+		Reason:       decided.Refusal,
+		Repositories: decided.Repositories,
+		RequestID:    contextvalues.GetRequestID(r.Context()),
+	}
+	if resp.Allowed {
+		resp.Permissions = decided.Permissions
+		event.GrantedPermissions = decided.Permissions
+	}
+	event.Outcome = audit.OutcomeExplained
+	event.Reason = decided.Refusal
+
+	jsonResp, err := json.Marshal(resp)
 	if err != nil {
 		srv.handleError(w, r, err, "cannot parse response", http.StatusInternalServerError)
 		return
 	}
-	reqLogger.Info("issued token")
 	_, _ = w.Write(jsonResp)
 }
 
-func (srv *Server) allowRepoAccess(logger *zap.Logger, organizationSlug string, pipelineSlug string, requestedRepo repoparser.RepositoryName) (bool, error) {
-	if strings.HasSuffix(requestedRepo.Repo, "-buildkite-plugin") {
-		// Always allow access to buildkite plugin repos
-		logger.Info("permit access to buildkite plugin repo",
-			zap.String("repository", requestedRepo.HTTPS()),
-		)
-		return true, nil
+// handleRevoke responds to DELETE /token requests by revoking all tokens issued to the calling job. Only tokens
+// this process minted are known, the response flags jobs without any, e.g. because another replica served them.
+func (srv *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	claims, _, ok := srv.authenticate(w, r, srv.current())
+	if !ok {
+		return
 	}
+	reqLogger := contextvalues.GetLogger(r.Context()).With(
+		zap.String("job_id", claims.JobID),
+		zap.String("organization_slug", claims.OrganizationSlug),
+		zap.String("pipeline_slug", claims.PipelineSlug),
+		zap.Int64("build_number", claims.BuildNumber),
+	)
 
-	// Check if the requested repo is associated with this pipeline
-	repo, err := srv.buildkite.GetPipelineRepo(organizationSlug, pipelineSlug)
+	revoked, known, err := srv.revokeJobTokens(r.Context(), reqLogger, claims.JobID)
 	if err != nil {
-		return false, err
+		srv.handleError(w, r, err, "cannot revoke all tokens", http.StatusInternalServerError)
+		return
 	}
-	buildkitePipelineRepo, err := repoparser.ExtractOrgRepoFromURL(repo)
-	if err != nil {
-		return false, fmt.Errorf("cannot parse repo %s: %s", repo, err)
+	if !known {
+		reqLogger.Info("no tokens known for job")
+	}
+	resp := api.RevokeResponse{
+		Revoked:   revoked,
+		Unknown:   !known,
+		RequestID: contextvalues.GetRequestID(r.Context()),
 	}
 
-	if buildkitePipelineRepo.Equals(requestedRepo) {
-		// Requested repo matches repo associated with pipeline that issued the token
-		logger.Info("permit access to repo associated with pipeline",
-			zap.String("repository", requestedRepo.HTTPS()),
-		)
-		return true, nil
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		srv.handleError(w, r, err, "cannot parse response", http.StatusInternalServerError)
+		return
 	}
+	_, _ = w.Write(jsonResp)
+}
 
-	// Do we have a github client for this git host?
-	if _, ok := srv.githubAppClients[requestedRepo.Host]; !ok {
-		return false, fmt.Errorf("no github client for %s", requestedRepo.Host)
+// authenticate verifies the Buildkite OIDC token of a request and ensures the Buildkite organization is permitted.
+// It responds with an error and returns false if not.
+func (srv *Server) authenticate(w http.ResponseWriter, r *http.Request, st *state) (buildkite.Claims, *config.ConfigOrganization, bool) {
+	requestToken := r.Header.Get("X-Buildkite-OIDC-Token")
+	splitToken := strings.Split(requestToken, "Bearer")
+	if len(splitToken) != 2 {
+		srv.handleError(w, r, nil, "invalid token", http.StatusForbidden)
+		return buildkite.Claims{}, nil, false
 	}
-	// Check if the requested repo has a gitops.yaml file pointing back to our origin repo
-	contents, status, err := srv.githubAppClients[requestedRepo.Host].GetContents(requestedRepo.Org, requestedRepo.Repo, "gitops.yaml")
-	if err != nil {
-		if status == http.StatusNotFound {
-			// Repo does not have a gitops.yaml file, deny access
-			//log.Printf("WARNING: repo %s does not have a gitops.yaml", requestedRepo.HTTPS())
-			return false, nil
-		}
 
-		// Other error getting gitops.yaml
-		return false, err
+	// parse the token, this validates:
+	//  * issuer
+	//  * signature
+	//  * expiry
+	//  * not before
+	//  * audience
+	verifiedToken, err := st.verifier.Verify([]byte(strings.TrimSpace(splitToken[1])))
+	if err != nil {
+		srv.handleError(w, r, err, "cannot verify token", http.StatusForbidden)
+		return buildkite.Claims{}, nil, false
 	}
 
-	// Repo has a gitops.yaml, parse it
-	gitops, err := github.GitOpsFromString(contents)
+	// ensure custom claims are set
+	claims, err := buildkite.ClaimsFromToken(verifiedToken)
 	if err != nil {
-		return false, fmt.Errorf("cannot parse gitops.yaml in %s: %s", requestedRepo.HTTPS(), err)
+		srv.handleError(w, r, err, err.Error(), http.StatusBadRequest)
+		return buildkite.Claims{}, nil, false
 	}
+	auditEvent(r.Context()).Claims = &claims
 
-	// Return true if the repo associated with the pipeline that made the request
-	// is listed as permitted in the requested repo
-	permitted := gitops.RepositoryPermitted(buildkitePipelineRepo)
-	if permitted {
-		logger.Info("permit access per gitops.yaml",
-			zap.String("repository", requestedRepo.HTTPS()),
-		)
+	// Reject organizations which are not on the allowlist before making any API calls
+	orgConfig, allowed := st.config.OrganizationConfig(claims.OrganizationSlug)
+	if !allowed {
+		srv.handleError(w, r, nil, fmt.Sprintf("buildkite organization %s is not permitted", claims.OrganizationSlug), http.StatusForbidden)
+		return buildkite.Claims{}, nil, false
+	}
+	return claims, orgConfig, true
+}
+
+// handleReady responds to /readyz requests. It fails once the server is shutting down, so load balancers stop
+// routing requests to it while requests in flight are drained.
+func (srv *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	// draining is expected, not an error worth logging
+	if srv.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status": "draining"}`))
+		return
 	}
-	return permitted, nil
+	_, _ = w.Write([]byte(`{"status": "ready"}`))
 }
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v48/github"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/audit"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+	ghclient "github.com/moensch/buildkite-github-token-server/internal/github"
+	"github.com/moensch/buildkite-github-token-server/internal/policy"
+	"github.com/moensch/buildkite-github-token-server/internal/tokenregistry"
+)
+
+// fakeGitHub is a stand-in for the GitHub app API which mints a token "ghs_<org>" per org
+type fakeGitHub struct {
+	mu       sync.Mutex
+	orgs     []string
+	failOrgs map[string]bool
+	minted   map[string]github.InstallationPermissions
+	revoked  []string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v3")
+	switch {
+	case path == "/app/installations":
+		fmt.Fprint(w, `[]`)
+	case strings.HasPrefix(path, "/orgs/") && strings.HasSuffix(path, "/installation"):
+		org := strings.TrimSuffix(strings.TrimPrefix(path, "/orgs/"), "/installation")
+		for idx, known := range f.orgs {
+			if known == org {
+				fmt.Fprintf(w, `{"id": %d}`, idx+1)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case strings.HasPrefix(path, "/app/installations/") && strings.HasSuffix(path, "/access_tokens"):
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "/app/installations/"), "/access_tokens"))
+		if err != nil || id < 1 || id > len(f.orgs) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		org := f.orgs[id-1]
+		if f.failOrgs[org] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var opts github.InstallationTokenOptions
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		f.minted[org] = *opts.Permissions
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "ghs_%s", "expires_at": %q}`, org, time.Now().Add(time.Hour).Format(time.RFC3339))
+	case path == "/installation/token" && r.Method == http.MethodDelete:
+		auth := r.Header.Get("Authorization")
+		f.revoked = append(f.revoked, auth[strings.LastIndex(auth, " ")+1:])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakeGitOps holds the gitops.yaml files of repositories by "<org>/<repo>"
+type fakeGitOps map[string]string
+
+func (f fakeGitOps) GetGitOps(owner string, repo string) (*ghclient.GitOps, error) {
+	contents, ok := f[fmt.Sprintf("%s/%s", owner, repo)]
+	if !ok {
+		return nil, nil
+	}
+	gitops, err := ghclient.GitOpsFromString(contents)
+	return &gitops, err
+}
+
+func (f fakeGitOps) GetOrgGitOps(org string) (*ghclient.OrgGitOps, error) {
+	return nil, nil
+}
+
+type fakePipelines map[string]string
+
+func (f fakePipelines) GetPipelineRepo(organizationSlug string, pipelineSlug string) (string, error) {
+	return f[fmt.Sprintf("%s/%s", organizationSlug, pipelineSlug)], nil
+}
+
+// recordingSink keeps the audit events written to it
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Write(event *audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func (s *recordingSink) last() *audit.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events[len(s.events)-1]
+}
+
+// handlerTest is a server for the pipeline myorg/deployer, with stand-ins for the OIDC issuer and the GitHub API
+type handlerTest struct {
+	srv     *Server
+	handler http.Handler
+	key     jwk.Key
+	github  *fakeGitHub
+	audit   *recordingSink
+	logs    *observer.ObservedLogs
+}
+
+func newHandlerTest(t *testing.T) *handlerTest {
+	t.Helper()
+	rawKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwk.FromRaw(rawKey)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, "test"))
+	require.NoError(t, key.Set(jwk.AlgorithmKey, jwa.RS256))
+	pubKey, err := key.PublicKey()
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(pubKey))
+
+	fake := &fakeGitHub{
+		orgs:     []string{"myorg", "otherorg"},
+		failOrgs: make(map[string]bool),
+		minted:   make(map[string]github.InstallationPermissions),
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			_ = json.NewEncoder(w).Encode(set)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(api.Close)
+
+	cfg := newTestConfig(api.URL, writeTestAppKey(t))
+	sink := &recordingSink{}
+	core, logs := observer.New(zap.WarnLevel)
+	srv := &Server{log: zap.New(core), config: cfg, tokens: tokenregistry.New(), audit: sink}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() { srv.Close() })
+
+	st, err := srv.buildState(cfg, nil)
+	require.NoError(t, err)
+	st.policy = &policy.Default{
+		Pipelines: fakePipelines{"myorg/deployer": "https://github.com/myorg/deployer.git"},
+		GitHub: func(host string) (policy.GitOpsGetter, error) {
+			return fakeGitOps{
+				"myorg/service":    "repos:\n  - github.com/myorg/deployer\n",
+				"myorg/readonly":   "repos:\n  - repo: github.com/myorg/deployer\n    access: read\n",
+				"myorg/checks":     "repos:\n  - repo: github.com/myorg/deployer\n    permissions:\n      checks: write\n",
+				"myorg/protected":  "protectedDestinations: [main]\nrepos:\n  - github.com/myorg/deployer\n",
+				"otherorg/service": "repos:\n  - github.com/myorg/deployer\n",
+			}, nil
+		},
+	}
+	srv.state.Store(st)
+
+	return &handlerTest{srv: srv, handler: srv.router(), key: key, github: fake, audit: sink, logs: logs}
+}
+
+// do sends a request authenticated as job "job-1" of the pipeline myorg/deployer
+func (ht *handlerTest) do(t *testing.T, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := jwt.NewBuilder().
+		Issuer("https://agent.buildkite.com").
+		Audience([]string{"test"}).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(5*time.Minute)).
+		Claim("job_id", "job-1").
+		Claim("organization_slug", "myorg").
+		Claim("pipeline_slug", "deployer").
+		Build()
+	require.NoError(t, err)
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, ht.key))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-Buildkite-OIDC-Token", "Bearer "+string(signed))
+	rec := httptest.NewRecorder()
+	ht.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandleToken(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		wantStatus      int
+		wantError       string
+		wantPermissions api.Permissions
+		wantOrgs        []string
+	}{
+		{
+			name:       "deny",
+			body:       `{"repositories": ["github.com/myorg/private"]}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "not allowed to access repo https://github.com/myorg/private.git: repository has no gitops.yaml",
+		},
+		{
+			name:       "noRepositories",
+			body:       `{"repositories": []}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "no repositories requested",
+		},
+		{
+			name:            "allow",
+			body:            `{"repositories": ["github.com/myorg/service"], "access_level": "write"}`,
+			wantStatus:      http.StatusOK,
+			wantPermissions: api.Permissions{"metadata": "read", "contents": "write", "pull_requests": "write"},
+			wantOrgs:        []string{"myorg"},
+		},
+		{
+			name:       "downgradeRefused",
+			body:       `{"repositories": ["github.com/myorg/readonly"], "access_level": "write"}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "repo https://github.com/myorg/readonly.git does not grant contents:write, pull_requests:write: gitops.yaml lists https://github.com/myorg/deployer.git",
+		},
+		{
+			name:            "downgrade",
+			body:            `{"repositories": ["github.com/myorg/service", "github.com/myorg/readonly"], "access_level": "write", "allow_downgrade": true}`,
+			wantStatus:      http.StatusOK,
+			wantPermissions: api.Permissions{"metadata": "read", "contents": "read", "pull_requests": "read"},
+			wantOrgs:        []string{"myorg"},
+		},
+		{
+			name:       "downgradeToMetadataOnly",
+			body:       `{"repositories": ["github.com/myorg/checks"], "access_level": "write", "allow_downgrade": true}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "no permissions besides metadata left to grant after downgrade",
+		},
+		{
+			name:       "protectedDestinations",
+			body:       `{"repositories": ["github.com/myorg/protected"], "access_level": "write"}`,
+			wantStatus: http.StatusForbidden,
+			wantError: "repo https://github.com/myorg/protected.git does not grant contents:write, pull_requests:write: " +
+				"gitops.yaml lists https://github.com/myorg/deployer.git but protects main, write access is not permitted from other repositories",
+		},
+		{
+			name:            "protectedDestinationsDowngrade",
+			body:            `{"repositories": ["github.com/myorg/protected"], "access_level": "write", "allow_downgrade": true}`,
+			wantStatus:      http.StatusOK,
+			wantPermissions: api.Permissions{"metadata": "read", "contents": "read", "pull_requests": "read"},
+			wantOrgs:        []string{"myorg"},
+		},
+		{
+			name:       "pluginWriteRefused",
+			body:       `{"repositories": ["github.com/myorg/docker-buildkite-plugin"], "access_level": "write"}`,
+			wantStatus: http.StatusForbidden,
+			wantError: "repo https://github.com/myorg/docker-buildkite-plugin.git does not grant contents:write, pull_requests:write: " +
+				"repository is a buildkite plugin, which is only readable",
+		},
+		{
+			name:            "pluginWriteDowngrade",
+			body:            `{"repositories": ["github.com/myorg/docker-buildkite-plugin"], "access_level": "write", "allow_downgrade": true}`,
+			wantStatus:      http.StatusOK,
+			wantPermissions: api.Permissions{"metadata": "read", "contents": "read", "pull_requests": "read"},
+			wantOrgs:        []string{"myorg"},
+		},
+		{
+			name:            "tokenPerOrg",
+			body:            `{"repositories": ["github.com/myorg/service", "github.com/otherorg/service"]}`,
+			wantStatus:      http.StatusOK,
+			wantPermissions: api.Permissions{"metadata": "read", "contents": "read", "pull_requests": "read"},
+			wantOrgs:        []string{"myorg", "otherorg"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ht := newHandlerTest(t)
+			rec := ht.do(t, http.MethodPost, "/token", tt.body)
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+
+			if tt.wantError != "" {
+				var httpErr api.HTTPError
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &httpErr))
+				assert.Equal(t, tt.wantError, httpErr.Message)
+				assert.Empty(t, ht.github.minted)
+				return
+			}
+
+			var resp api.TokenResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantPermissions, resp.Permissions)
+			require.Len(t, resp.Tokens, len(tt.wantOrgs))
+			for idx, org := range tt.wantOrgs {
+				assert.Equal(t, org, resp.Tokens[idx].Organization)
+				assert.Equal(t, "ghs_"+org, resp.Tokens[idx].Token)
+				assert.Contains(t, ht.github.minted, org)
+			}
+			tokens, _ := ht.srv.tokens.Take("job-1")
+			assert.Len(t, tokens, len(tt.wantOrgs))
+		})
+	}
+}
+
+func TestHandleTokenMintFailure(t *testing.T) {
+	ht := newHandlerTest(t)
+	ht.github.failOrgs["otherorg"] = true
+
+	rec := ht.do(t, http.MethodPost, "/token", `{"repositories": ["github.com/myorg/service", "github.com/otherorg/service"]}`)
+	require.Equal(t, http.StatusInternalServerError, rec.Code, rec.Body.String())
+	assert.Contains(t, ht.github.minted, "myorg")
+	assert.Equal(t, []string{"ghs_myorg"}, ht.github.revoked, "tokens minted for other orgs are revoked")
+	tokens, _ := ht.srv.tokens.Take("job-1")
+	assert.Empty(t, tokens)
+}
+
+func TestHandleTokenAuditDecisions(t *testing.T) {
+	ht := newHandlerTest(t)
+	rec := ht.do(t, http.MethodPost, "/token", `{"repositories": ["github.com/myorg/private", "github.com/myorg/service"]}`)
+	require.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+
+	event := ht.audit.last()
+	assert.Equal(t, audit.OutcomeDenied, event.Outcome)
+	require.Len(t, event.Decisions, 1, "repositories after the denied one are not evaluated")
+	assert.Equal(t, "https://github.com/myorg/private.git", event.Decisions[0].Repository)
+	assert.False(t, event.Decisions[0].Allowed)
+}
+
+func TestAuditMiddlewarePanic(t *testing.T) {
+	ht := newHandlerTest(t)
+	handler := ht.srv.auditMiddleware(audit.EventTokenRequest, func(w http.ResponseWriter, r *http.Request) {
+		auditEvent(r.Context()).Repositories = []string{"https://github.com/myorg/service.git"}
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/token", nil)
+	req = req.WithContext(contextvalues.SetRequestID(req.Context(), "req-1"))
+	assert.Panics(t, func() {
+		handler(httptest.NewRecorder(), req)
+	}, "the panic is passed on to middlewareRecoverer")
+	event := ht.audit.last()
+	assert.Equal(t, "req-1", event.RequestID)
+	assert.Equal(t, http.StatusInternalServerError, event.Status)
+	assert.Equal(t, audit.OutcomeError, event.Outcome)
+	assert.Equal(t, []string{"https://github.com/myorg/service.git"}, event.Repositories)
+}
+
+func TestHandleExplain(t *testing.T) {
+	ht := newHandlerTest(t)
+	body := `{"repositories": ["github.com/myorg/private", "github.com/myorg/service"]}`
+	rec := ht.do(t, http.MethodPost, "/token/explain", body)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp api.ExplainResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.False(t, resp.Allowed)
+	require.Len(t, resp.Repositories, 2, "all repositories are explained")
+	assert.False(t, resp.Repositories[0].Allowed)
+	assert.True(t, resp.Repositories[1].Allowed)
+	assert.Empty(t, ht.github.minted)
+
+	event := ht.audit.last()
+	assert.Equal(t, audit.EventTokenExplain, event.Type)
+	assert.Equal(t, audit.OutcomeExplained, event.Outcome)
+	assert.Equal(t, resp.Reason, event.Reason)
+	assert.Len(t, event.Decisions, 2)
+
+	// /token refuses the same request for the same reason
+	rec = ht.do(t, http.MethodPost, "/token", body)
+	require.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+	var errResp api.HTTPError
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &errResp))
+	assert.Equal(t, resp.Reason, errResp.Message)
+}
+
+func TestHandleRevoke(t *testing.T) {
+	ht := newHandlerTest(t)
+	rec := ht.do(t, http.MethodPost, "/token", `{"repositories": ["github.com/myorg/service", "github.com/otherorg/service"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = ht.do(t, http.MethodDelete, "/token", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp api.RevokeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Revoked)
+	assert.ElementsMatch(t, []string{"ghs_myorg", "ghs_otherorg"}, ht.github.revoked)
+	assert.Equal(t, audit.OutcomeRevoked, ht.audit.last().Outcome)
+
+	rec = ht.do(t, http.MethodDelete, "/token", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	resp = api.RevokeResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 0, resp.Revoked, "tokens are only revoked once")
+	assert.False(t, resp.Unknown, "the job's tokens were already revoked")
+
+	t.Run("unknownJob", func(t *testing.T) {
+		rec := newHandlerTest(t).do(t, http.MethodDelete, "/token", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp api.RevokeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, 0, resp.Revoked)
+		assert.True(t, resp.Unknown)
+	})
+}
+
+func TestHandleBuildkiteWebhook(t *testing.T) {
+	ht := newHandlerTest(t)
+	ht.srv.config.WebhookToken = "secret"
+	handler := ht.srv.router()
+
+	rec := ht.do(t, http.MethodPost, "/token", `{"repositories": ["github.com/myorg/service"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	finished := func(jobID string) api.RevokeResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/webhooks/buildkite", strings.NewReader(fmt.Sprintf(`{"event": "job.finished", "job": {"id": %q}}`, jobID)))
+		req.Header.Set("X-Buildkite-Token", "secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp api.RevokeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	resp := finished("job-1")
+	assert.Equal(t, 1, resp.Revoked)
+	assert.False(t, resp.Unknown)
+	assert.Zero(t, ht.logs.Len())
+
+	resp = finished("job-2")
+	assert.True(t, resp.Unknown)
+	assert.Equal(t, 1, ht.logs.FilterMessageSnippet("finished job has no registered tokens").Len())
+}
@@ -16,6 +16,7 @@ import (
 // err: if err is type api.HTTPError then it will get JSON-marshalled and returned to the user, this is for public consumption
 func (srv *Server) handleError(w http.ResponseWriter, r *http.Request, err error, msg string, code int) {
 	w.WriteHeader(code)
+	auditEvent(r.Context()).Reason = msg
 
 	httpErr, isHTTPError := err.(*api.HTTPError)
 	if !isHTTPError {
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/github"
+	"github.com/moensch/buildkite-github-token-server/internal/jwks"
+	"github.com/moensch/buildkite-github-token-server/internal/metrics"
+	"github.com/moensch/buildkite-github-token-server/internal/policy"
+)
+
+// state is everything the server builds from its config file. A reload replaces it as a whole, and each request
+// loads it once, so requests in flight keep using the state they started with.
+type state struct {
+	config     config.Config
+	verifier   *jwks.Verifier
+	githubApps map[string]*githubApp
+	policy     policy.Policy
+
+	// stopVerifier stops refreshing the verifier's JWKS
+	stopVerifier context.CancelFunc
+}
+
+// githubApp is the client of a GitHub host and the app config it was built from
+type githubApp struct {
+	config config.ConfigApplication
+	client *github.Client
+
+	// stop stops the client's background workers
+	stop context.CancelFunc
+}
+
+// githubClient returns the GitHub app client for a given GitHub host
+func (st *state) githubClient(host string) (*github.Client, bool) {
+	app, ok := st.githubApps[host]
+	if !ok {
+		return nil, false
+	}
+	return app.client, true
+}
+
+// githubClientForHost is githubClient for the policy package
+func (st *state) githubClientForHost(host string) (policy.GitOpsGetter, error) {
+	client, ok := st.githubClient(host)
+	if !ok {
+		return nil, fmt.Errorf("no github client for %s", host)
+	}
+	return client, nil
+}
+
+// release stops the background workers of everything in st which next does not use. next may be nil.
+func (st *state) release(next *state) {
+	if st.stopVerifier != nil && (next == nil || next.verifier != st.verifier) {
+		st.stopVerifier()
+	}
+	for host, app := range st.githubApps {
+		if next == nil || next.githubApps[host] != app {
+			app.stop()
+		}
+	}
+}
+
+// current returns the state requests are served with
+func (srv *Server) current() *state {
+	return srv.state.Load()
+}
+
+// buildState builds the state for a config. Verifiers and GitHub clients of the previous state, if any, are
+// reused if their config did not change.
+func (srv *Server) buildState(cfg config.Config, previous *state) (*state, error) {
+	st := &state{
+		config:     cfg,
+		githubApps: make(map[string]*githubApp),
+	}
+	if err := srv.populateState(st, previous); err != nil {
+		st.release(previous)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (srv *Server) populateState(st *state, previous *state) error {
+	if previous != nil && reflect.DeepEqual(previous.config.OIDCIssuers(), st.config.OIDCIssuers()) {
+		st.verifier, st.stopVerifier = previous.verifier, previous.stopVerifier
+	} else {
+		ctx, cancel := context.WithCancel(srv.ctx)
+		verifier, err := jwks.NewVerifier(ctx, srv.log, st.config.OIDCIssuers())
+		if err != nil {
+			cancel()
+			return err
+		}
+		st.verifier, st.stopVerifier = verifier, cancel
+	}
+
+	for _, app := range st.config.Applications {
+		// NewClientForHost adds the app's installations to its config, compare the config as configured
+		appConfig := *app
+		if previous != nil {
+			if previousApp, ok := previous.githubApps[app.Host]; ok && reflect.DeepEqual(previousApp.config, appConfig) {
+				st.githubApps[app.Host] = previousApp
+				continue
+			}
+		}
+
+		client, err := github.NewClientForHost(&st.config, app.Host)
+		if err != nil {
+			return fmt.Errorf("cannot initialize github client for %s: %w", app.Host, err)
+		}
+		// cache settings are only read at startup, clients rebuilt on reload use the same ones as the others
+		if srv.config.GitOpsCacheTTL > 0 {
+			client = client.WithGitOpsCache(srv.config.GitOpsCacheTTL, srv.config.GitOpsNotFoundTTL, srv.config.GitOpsCacheSize)
+		}
+		ctx, cancel := context.WithCancel(srv.ctx)
+		srv.background(func() {
+			client.RefreshOrgClients(ctx, srv.log, time.Minute)
+		})
+		st.githubApps[app.Host] = &githubApp{
+			config: appConfig,
+			client: client,
+			stop:   cancel,
+		}
+	}
+
+	// Rules from the policy file take precedence over the built-in rules
+	chain := policy.Chain{}
+	if st.config.PolicyPath != "" {
+		filePolicy, err := policy.NewFileFromPath(st.config.PolicyPath)
+		if err != nil {
+			return err
+		}
+		srv.log.Info("loaded policy file",
+			zap.String("filepath", st.config.PolicyPath),
+			zap.Int("rules", len(filePolicy.Rules)),
+		)
+		chain = append(chain, filePolicy)
+	}
+	st.policy = append(chain, &policy.Default{
+		Pipelines: srv.buildkite,
+		GitHub:    st.githubClientForHost,
+	})
+	return nil
+}
+
+// Reload reads the config file at path again and swaps in a new state. Only GitHub clients whose app config
+// changed are rebuilt. If the new config is invalid, the current state is kept. The port, audit sinks, cache
+// settings and webhook settings are only read at startup, rebuilt GitHub clients keep the gitops cache settings
+// the server started with. The server must be initialized.
+func (srv *Server) Reload(path string) error {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+	if srv.ctx == nil {
+		return fmt.Errorf("server is not initialized")
+	}
+	// a closed server's background workers are stopped, a new state would never be released
+	if srv.ctx.Err() != nil {
+		return nil
+	}
+
+	err := srv.reload(path)
+	if err != nil {
+		metrics.PromMetrics.ConfigReloads.WithLabelValues("failure").Inc()
+		srv.log.Error("cannot reload config",
+			zap.String("filepath", path),
+			zap.Error(err),
+		)
+		return err
+	}
+	metrics.PromMetrics.ConfigReloads.WithLabelValues("success").Inc()
+	srv.log.Info("reloaded config", zap.String("filepath", path))
+	return nil
+}
+
+func (srv *Server) reload(path string) error {
+	previous := srv.current()
+	cfg, err := config.ReloadConfig(path, &previous.config)
+	if err != nil {
+		return err
+	}
+	next, err := srv.buildState(*cfg, previous)
+	if err != nil {
+		return err
+	}
+	srv.state.Store(next)
+	previous.release(next)
+	return nil
+}
+
+// WatchConfig starts reloading the config file at path on SIGHUP, and whenever the file changes, until the
+// server closes. The file is checked for changes every interval, 0 disables the check. The server must be
+// initialized.
+func (srv *Server) WatchConfig(path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	srv.background(func() {
+		defer signal.Stop(hup)
+		srv.watchConfig(path, interval, hup)
+	})
+}
+
+func (srv *Server) watchConfig(path string, interval time.Duration, hup <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	lastModified := fileVersion(path)
+	for {
+		select {
+		case <-srv.ctx.Done():
+			return
+		case <-hup:
+			srv.log.Info("signal", zap.String("sig", "hangup"))
+			lastModified = fileVersion(path)
+			_ = srv.Reload(path)
+		case <-tick:
+			modified := fileVersion(path)
+			// a missing file is most likely being replaced, e.g. a Kubernetes config map being updated
+			if modified == "" || modified == lastModified {
+				continue
+			}
+			lastModified = modified
+			_ = srv.Reload(path)
+		}
+	}
+}
+
+// fileVersion identifies the version of a file by its modification time and size, or is empty if the file
+// cannot be read
+func fileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+	"github.com/moensch/buildkite-github-token-server/internal/metrics"
+)
+
+// newReloadTestServer returns a server and a function writing its config file for a list of GitHub hosts
+func newReloadTestServer(t *testing.T) (*Server, string, func(hosts ...string)) {
+	t.Helper()
+	t.Setenv("BUILDKITE_TOKEN", "x")
+	apiURL, keyPath := newTestAPI(t)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(hosts ...string) {
+		contents := fmt.Sprintf("issuers:\n  - issuer: https://agent.buildkite.com\n    jwksURL: %s/jwks\n    audiences: [test]\napplications:\n", apiURL)
+		for _, host := range hosts {
+			contents += fmt.Sprintf("  - host: %s\n    appID: 1\n    privateKeyPath: %s\n    apiURL: %s/api/v3/\n", host, keyPath, apiURL)
+		}
+		require.NoError(t, os.WriteFile(configPath, []byte(contents), 0600))
+	}
+
+	srv := &Server{log: zap.NewNop()}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	t.Cleanup(srv.cancel)
+	return srv, configPath, writeConfig
+}
+
+func TestReload(t *testing.T) {
+	srv, configPath, writeConfig := newReloadTestServer(t)
+	writeConfig("github.com")
+	cfg, err := config.NewConfig(configPath)
+	require.NoError(t, err)
+	st, err := srv.buildState(*cfg, nil)
+	require.NoError(t, err)
+	srv.state.Store(st)
+
+	t.Run("unchangedClientsKept", func(t *testing.T) {
+		before := srv.current()
+		writeConfig("github.com", "github.example.com")
+		require.NoError(t, srv.Reload(configPath))
+
+		after := srv.current()
+		assert.NotSame(t, before, after)
+		assert.Same(t, before.verifier, after.verifier)
+		assert.Same(t, before.githubApps["github.com"], after.githubApps["github.com"])
+		_, ok := after.githubClient("github.example.com")
+		assert.True(t, ok)
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PromMetrics.ConfigReloads.WithLabelValues("success")))
+	})
+
+	t.Run("removedClientsDropped", func(t *testing.T) {
+		writeConfig("github.com")
+		require.NoError(t, srv.Reload(configPath))
+		_, ok := srv.current().githubClient("github.example.com")
+		assert.False(t, ok)
+	})
+
+	t.Run("signerKept", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		cfg, err := config.NewConfig(configPath)
+		require.NoError(t, err)
+		cfg.Applications[0].Signer = key
+		st, err := srv.buildState(*cfg, srv.current())
+		require.NoError(t, err)
+		srv.state.Swap(st).release(st)
+
+		require.NoError(t, srv.Reload(configPath))
+		assert.Same(t, st.githubApps["github.com"], srv.current().githubApps["github.com"])
+		assert.Same(t, key, srv.current().config.Applications[0].Signer)
+	})
+
+	t.Run("invalidConfigKeepsState", func(t *testing.T) {
+		before := srv.current()
+		require.NoError(t, os.WriteFile(configPath, []byte("applications: {"), 0600))
+		assert.Error(t, srv.Reload(configPath))
+		assert.Same(t, before, srv.current())
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PromMetrics.ConfigReloads.WithLabelValues("failure")))
+	})
+
+	t.Run("uninitializedServer", func(t *testing.T) {
+		assert.EqualError(t, (&Server{log: zap.NewNop()}).Reload(configPath), "server is not initialized")
+	})
+
+	t.Run("closedServerNotReloaded", func(t *testing.T) {
+		writeConfig("github.com")
+		require.NoError(t, srv.Reload(configPath))
+		before := srv.current()
+		srv.cancel()
+		writeConfig("github.com", "github.example.com")
+		require.NoError(t, srv.Reload(configPath))
+		assert.Same(t, before, srv.current())
+	})
+}
+
+func TestWatchConfig(t *testing.T) {
+	srv, configPath, writeConfig := newReloadTestServer(t)
+	writeConfig("github.com")
+	cfg, err := config.NewConfig(configPath)
+	require.NoError(t, err)
+	st, err := srv.buildState(*cfg, nil)
+	require.NoError(t, err)
+	srv.state.Store(st)
+
+	srv.WatchConfig(configPath, 10*time.Millisecond)
+	// let the watcher note the current file version first
+	time.Sleep(20 * time.Millisecond)
+	writeConfig("github.com", "github.example.com")
+	assert.Eventually(t, func() bool {
+		_, ok := srv.current().githubClient("github.example.com")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	// Close waits for the watcher to stop
+	require.NoError(t, srv.Close())
+}
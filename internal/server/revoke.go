@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/internal/audit"
+	"github.com/moensch/buildkite-github-token-server/internal/tokenregistry"
+)
+
+// revokeJobTokens revokes all unexpired tokens issued to a Buildkite job. Tokens which could not be
+// revoked are kept in the registry so a later attempt can retry them. known is false if the registry has no
+// record of tokens issued to the job, see tokenregistry.Registry.
+func (srv *Server) revokeJobTokens(ctx context.Context, logger *zap.Logger, jobID string) (revoked int, known bool, err error) {
+	event := auditEvent(ctx)
+	var (
+		failed  []tokenregistry.Token
+		lastErr error
+	)
+	st := srv.current()
+	tokens, known := srv.tokens.Take(jobID)
+	for _, token := range tokens {
+		client, ok := st.githubClient(token.Host)
+		if !ok {
+			lastErr = fmt.Errorf("no github app configured for %s", token.Host)
+			failed = append(failed, token)
+			continue
+		}
+		if err := client.RevokeInstallationToken(token.Token); err != nil {
+			logger.Error("cannot revoke token",
+				zap.String("host", token.Host),
+				zap.String("org", token.Organization),
+				zap.Error(err),
+			)
+			lastErr = err
+			failed = append(failed, token)
+			continue
+		}
+		revoked++
+		event.Tokens = append(event.Tokens, audit.Token{
+			Host:         token.Host,
+			Organization: token.Organization,
+			ExpiresAt:    token.ExpiresAt,
+			Fingerprint:  audit.Fingerprint(token.Token),
+		})
+		logger.Info("revoked token",
+			zap.String("host", token.Host),
+			zap.String("org", token.Organization),
+			zap.Time("expires_at", token.ExpiresAt),
+		)
+	}
+	if revoked > 0 {
+		event.Outcome = audit.OutcomeRevoked
+	}
+	if len(failed) > 0 {
+		srv.tokens.Add(jobID, failed...)
+		return revoked, known, fmt.Errorf("%d of %d tokens not revoked: %w", len(failed), revoked+len(failed), lastErr)
+	}
+	return revoked, known, nil
+}
+
+// revokeUnused revokes tokens minted for a request which failed before returning them. Tokens which cannot be
+// revoked are registered for the job, so revoking the job's tokens retries them.
+func (srv *Server) revokeUnused(logger *zap.Logger, st *state, jobID string, tokens []tokenregistry.Token) {
+	for _, token := range tokens {
+		client, ok := st.githubClient(token.Host)
+		if !ok {
+			srv.tokens.Add(jobID, token)
+			continue
+		}
+		if err := client.RevokeInstallationToken(token.Token); err != nil {
+			logger.Error("cannot revoke unused token",
+				zap.String("host", token.Host),
+				zap.String("org", token.Organization),
+				zap.Error(err),
+			)
+			srv.tokens.Add(jobID, token)
+			continue
+		}
+		logger.Info("revoked unused token",
+			zap.String("host", token.Host),
+			zap.String("org", token.Organization),
+		)
+	}
+}
@@ -1,24 +1,24 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
-	"os"
-	"os/signal"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi"
 	"go.uber.org/zap"
 
+	"github.com/moensch/buildkite-github-token-server/internal/audit"
 	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
 	"github.com/moensch/buildkite-github-token-server/internal/config"
-	"github.com/moensch/buildkite-github-token-server/internal/github"
-	"github.com/moensch/buildkite-github-token-server/internal/jwks"
 	"github.com/moensch/buildkite-github-token-server/internal/metrics"
+	"github.com/moensch/buildkite-github-token-server/internal/tokenregistry"
 )
 
 // Version holds the app version (Set at compile time)
@@ -27,38 +27,46 @@ var Version = "dev"
 // appName holds the application name used for things such as log lines and metrics labels
 var appName = "buildkite-github-token-server"
 
-const (
-	jwksURL     = "https://agent.buildkite.com/.well-known/jwks"
-	jwtAudience = "https://buildkite.com/twilio-sandbox"
-	jwtIssuer   = "https://agent.buildkite.com"
-)
-
 type Server struct {
-	jwkCache         *jwks.JWKS
-	httpServer       *http.Server
-	config           config.Config
-	log              *zap.Logger
-	buildkite        *buildkite.Client
-	github           *github.Client
-	githubAppClients map[string]*github.Client
-	port             string
+	// ctx is cancelled when the server closes, stopping background workers
+	ctx        context.Context
+	cancel     context.CancelFunc
+	httpServer *http.Server
+	config     config.Config // the config the server started with, see state for what can be reloaded
+	state      atomic.Pointer[state]
+	reloadMu   sync.Mutex
+	log        *zap.Logger
+	buildkite  *buildkite.Client
+	tokens     *tokenregistry.Registry // issued tokens per Buildkite job, for revocation
+	workers    sync.WaitGroup          // background workers, which stop when ctx is cancelled
+	draining   atomic.Bool             // set once shutdown began, see handleReady
+	audit      audit.Sink
+	port       string
 }
 
-func New(c config.Config) *Server {
+// New returns a server for a config. Call Initialize before Run.
+func New(c config.Config) (*Server, error) {
 	logger, err := zap.NewProduction()
-
 	if err != nil {
-		log.Fatalf("can't initialize zap logger: %v", err)
+		return nil, fmt.Errorf("can't initialize zap logger: %w", err)
+	}
+	bkClient := buildkite.NewClient(c.BuildkiteToken)
+	if c.PipelineCacheTTL > 0 {
+		bkClient = bkClient.WithPipelineCache(c.PipelineCacheTTL, c.PipelineCacheSize)
 	}
 	return &Server{
 		log:       logger.With(zap.String("application", appName), zap.String("version", Version)),
 		port:      c.Port,
 		config:    c,
-		buildkite: buildkite.NewClient(c.BuildkiteToken),
-	}
+		buildkite: bkClient,
+		tokens:    tokenregistry.New(),
+		audit:     audit.Multi{},
+	}, nil
 }
 
 func (srv *Server) Initialize() error {
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+
 	metrics.InitializeMetrics(metrics.Config{
 		Prefix: strings.ReplaceAll(appName, "-", "_"),
 		Labels: map[string]string{
@@ -76,83 +84,148 @@ func (srv *Server) Initialize() error {
 		},
 	})
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
-		srv.log.Info("signal",
-			zap.String("sig", fmt.Sprint(sig)),
-		)
-		srv.Close()
-	}()
+	srv.background(func() {
+		srv.tokens.Run(srv.ctx, time.Minute)
+	})
+
+	if len(srv.config.Organizations) == 0 {
+		srv.log.Warn("no organizations allowlist configured, accepting tokens of any buildkite organization")
+	}
+
+	auditSink, err := audit.NewSinkFromConfig(srv.log, srv.config.Audit)
+	if err != nil {
+		return fmt.Errorf("cannot initialize audit log: %w", err)
+	}
+	srv.audit = auditSink
 
 	// initialize additional clients
-	cache, err := jwks.New(srv.log, jwksURL)
+	st, err := srv.buildState(srv.config, nil)
 	if err != nil {
 		return err
 	}
-	srv.jwkCache = cache
+	srv.state.Store(st)
 
-	srv.githubAppClients = make(map[string]*github.Client)
-	for _, app := range srv.config.Applications {
-		client, err := github.NewClientForHost(&srv.config, app.Host)
-		if err != nil {
-			return fmt.Errorf("cannot initialize github client for %s: %w", app.Host, err)
-		}
-		srv.githubAppClients[app.Host] = client
-	}
+	srv.httpServer = &http.Server{Handler: srv.router()}
+	// TODO add timeouts to config
+	srv.httpServer.WriteTimeout = 1 * time.Minute
+	srv.httpServer.ReadTimeout = 1 * time.Minute
 
 	return nil
 }
 
-// Serve starts http server running on the port set in srv
-func (srv *Server) Serve() {
-	defer srv.Close()
+// Run serves requests on the configured port until ctx is done, then shuts down gracefully. It returns an error if
+// the server cannot listen or stops unexpectedly.
+func (srv *Server) Run(ctx context.Context) error {
 	address := fmt.Sprintf(":%s", srv.port)
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		srv.log.Error("unable to serve",
-			zap.Error(err),
-			zap.String("address", address),
-			zap.String("port", srv.port),
-		)
-		os.Exit(1)
+		srv.Close()
+		return fmt.Errorf("unable to listen on %s: %w", address, err)
 	}
-	srv.listen(listener)
+	return srv.serve(ctx, listener)
 }
 
-// listen starts a server on the given listener. It allows for easier testability of the server.
-func (srv *Server) listen(listener net.Listener) {
+// serve runs the server on the given listener. It allows for easier testability of the server.
+func (srv *Server) serve(ctx context.Context, listener net.Listener) error {
+	if srv.httpServer == nil {
+		listener.Close()
+		return fmt.Errorf("server is not initialized")
+	}
+
+	// re-discover what port we are on. If config was to port :0, this will allow us to know what port we bound to
+	port := listener.Addr().(*net.TCPAddr).Port
+	srv.log.Info("server listening", zap.Int("port", port))
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			// closed by Shutdown or Close
+			return nil
+		}
+		srv.Close()
+		return fmt.Errorf("server crash: %w", err)
+	case <-ctx.Done():
+	}
+
+	// keep serving until load balancers noticed /readyz failing
+	srv.draining.Store(true)
+	srv.log.Info("draining",
+		zap.Duration("delay", srv.config.ShutdownDelay),
+		zap.Duration("drain_timeout", srv.config.ShutdownDrainTimeout),
+	)
+	select {
+	case <-time.After(srv.config.ShutdownDelay):
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		srv.Close()
+		return fmt.Errorf("server crash: %w", err)
+	}
+
+	srv.log.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), srv.config.ShutdownDrainTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// background runs a background worker, which must return once srv.ctx is cancelled. Close waits for them.
+func (srv *Server) background(worker func()) {
+	srv.workers.Add(1)
+	go func() {
+		defer srv.workers.Done()
+		worker()
+	}()
+}
+
+// router returns the handler of all endpoints
+func (srv *Server) router() http.Handler {
 	router := chi.NewRouter()
 	router.Use(srv.middlewareRecoverer)       // ensure server does not crash on panic
 	router.Use(srv.jsonContentTypeMiddleware) // always set application/json content type
 	router.Use(srv.logMiddleware)             // log all requests
 
-	router.Post("/token", metricsMiddleware("token", srv.handleToken))
+	router.Post("/token", metricsMiddleware("token", srv.auditMiddleware(audit.EventTokenRequest, srv.handleToken)))
+	router.Post("/token/explain", metricsMiddleware("explain", srv.auditMiddleware(audit.EventTokenExplain, srv.handleExplain)))
+	router.Delete("/token", metricsMiddleware("revoke", srv.auditMiddleware(audit.EventTokenRevoke, srv.handleRevoke)))
+	if srv.config.WebhookToken != "" || srv.config.WebhookSecret != "" {
+		router.Post("/webhooks/buildkite", metricsMiddleware("webhook", srv.auditMiddleware(audit.EventTokenRevoke, srv.handleBuildkiteWebhook)))
+	}
 	router.Get("/metrics", metricsMiddleware("metrics", metrics.PromMetrics.ServeHTTP))
+	router.Get("/readyz", metricsMiddleware("readyz", srv.handleReady))
+	return router
+}
 
-	// re-discover what port we are on. If config was to port :0, this will allow us to know what port we bound to
-	port := listener.Addr().(*net.TCPAddr).Port
-	srv.port = fmt.Sprintf("%d", port)
-	srv.log.Info("server listening", zap.String("port", srv.port))
-
-	srv.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: router}
-	// TODO add timeouts to config
-	srv.httpServer.WriteTimeout = 1 * time.Minute
-	srv.httpServer.ReadTimeout = 1 * time.Minute
-
-	if err := srv.httpServer.Serve(listener); err != nil {
-		if err != http.ErrServerClosed {
-			srv.log.Error("server crash", zap.Error(err))
-			os.Exit(1)
+// Shutdown stops accepting new requests and waits for requests in flight until ctx is done, then drops the
+// remaining requests and performs the cleanup of Close
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.draining.Store(true)
+	var errs error
+	if srv.httpServer != nil {
+		if err := srv.httpServer.Shutdown(ctx); err != nil {
+			srv.log.Warn("requests in flight did not finish in time", zap.Error(err))
+			errs = fmt.Errorf("error shutting down server: %w", err)
 		}
 	}
+	if err := srv.Close(); err != nil {
+		errs = err
+	}
+	return errs
 }
 
 // Close performs any remaining cleanup and shuts down
 func (srv *Server) Close() error {
 	// potentially doing many things that could error. Keep all errors and return at the end.
 	var errs error
+	// stop background workers
+	if srv.cancel != nil {
+		srv.cancel()
+	}
 	// close socket to stop new requests from coming in
 	if srv.httpServer != nil {
 		err := srv.httpServer.Close()
@@ -160,6 +233,13 @@ func (srv *Server) Close() error {
 			errs = fmt.Errorf("error closing server: %w", err)
 		}
 	}
+	srv.workers.Wait()
+	if srv.audit != nil {
+		err := srv.audit.Close()
+		if err != nil {
+			errs = fmt.Errorf("error closing audit log: %w", err)
+		}
+	}
 
 	return errs
 }
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moensch/buildkite-github-token-server/internal/config"
+)
+
+// newTestAPI starts a stand-in for the JWKS and GitHub APIs and returns its URL and the path of a GitHub app key.
+// Requests below /broken/ fail.
+func newTestAPI(t *testing.T) (string, string) {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jwks":
+			fmt.Fprint(w, `{"keys": []}`)
+		case "/api/v3/app/installations":
+			fmt.Fprint(w, `[]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api.URL, writeTestAppKey(t)
+}
+
+// writeTestAppKey writes a GitHub app key and returns its path
+func writeTestAppKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "app.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return keyPath
+}
+
+// newTestConfig returns a valid config using the stand-in API
+func newTestConfig(apiURL string, keyPath string) config.Config {
+	return config.Config{
+		Port:           "0",
+		BuildkiteToken: "x",
+		ContextTimeout: time.Second,
+		// tests set ShutdownDelay when they check readiness while draining
+		ShutdownDrainTimeout: 5 * time.Second,
+		Issuers: []*config.ConfigIssuer{
+			{Issuer: "https://agent.buildkite.com", JWKSURL: apiURL + "/jwks", Audiences: []string{"test"}},
+		},
+		Applications: []*config.ConfigApplication{
+			{Host: "github.com", AppID: 1, PrivateKeyPath: keyPath, APIURL: apiURL + "/api/v3/"},
+		},
+	}
+}
+
+func TestInitializeFailures(t *testing.T) {
+	apiURL, keyPath := newTestAPI(t)
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *config.Config)
+		wantErr string
+	}{
+		{
+			name:    "jwksUnavailable",
+			modify:  func(cfg *config.Config) { cfg.Issuers[0].JWKSURL = apiURL + "/broken/jwks" },
+			wantErr: "cannot fetch JWKS",
+		},
+		{
+			name:    "githubUnavailable",
+			modify:  func(cfg *config.Config) { cfg.Applications[0].APIURL = apiURL + "/broken/api/v3/" },
+			wantErr: "cannot initialize github client for github.com",
+		},
+		{
+			name:    "privateKeyMissing",
+			modify:  func(cfg *config.Config) { cfg.Applications[0].PrivateKeyPath = "doesnotexist.pem" },
+			wantErr: "could not read private key",
+		},
+		{
+			name:    "policyFileMissing",
+			modify:  func(cfg *config.Config) { cfg.PolicyPath = "doesnotexist.yaml" },
+			wantErr: "doesnotexist.yaml",
+		},
+		{
+			name: "auditSinkInvalid",
+			modify: func(cfg *config.Config) {
+				cfg.Audit.Sinks = []*config.ConfigAuditSink{{Type: "file", Path: filepath.Join(t.TempDir(), "missing", "audit.jsonl")}}
+			},
+			wantErr: "cannot initialize audit log",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(apiURL, keyPath)
+			tt.modify(&cfg)
+			srv, err := New(cfg)
+			require.NoError(t, err)
+			defer srv.Close()
+			assert.ErrorContains(t, srv.Initialize(), tt.wantErr)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	apiURL, keyPath := newTestAPI(t)
+
+	t.Run("portInUse", func(t *testing.T) {
+		listener, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		cfg := newTestConfig(apiURL, keyPath)
+		cfg.Port = fmt.Sprintf("%d", listener.Addr().(*net.TCPAddr).Port)
+		srv, err := New(cfg)
+		require.NoError(t, err)
+		require.NoError(t, srv.Initialize())
+		assert.ErrorContains(t, srv.Run(context.Background()), "unable to listen")
+	})
+
+	t.Run("notInitialized", func(t *testing.T) {
+		srv, err := New(newTestConfig(apiURL, keyPath))
+		require.NoError(t, err)
+		assert.Error(t, srv.Run(context.Background()))
+	})
+
+	t.Run("gracefulShutdown", func(t *testing.T) {
+		srv, err := New(newTestConfig(apiURL, keyPath))
+		require.NoError(t, err)
+		require.NoError(t, srv.Initialize())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		url := fmt.Sprintf("http://%s/metrics", listener.Addr())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.serve(ctx, listener)
+		}()
+
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not shut down")
+		}
+		assert.ErrorIs(t, srv.ctx.Err(), context.Canceled, "background workers are stopped")
+
+		_, err = http.Get(url)
+		assert.Error(t, err)
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		cfg := newTestConfig(apiURL, keyPath)
+		cfg.ShutdownDelay = 200 * time.Millisecond
+		srv, err := New(cfg)
+		require.NoError(t, err)
+		require.NoError(t, srv.Initialize())
+
+		// a request which is still in flight when draining ends
+		slowStarted := make(chan struct{})
+		router := srv.httpServer.Handler
+		srv.httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(slowStarted)
+				time.Sleep(500 * time.Millisecond)
+				fmt.Fprint(w, "done")
+				return
+			}
+			router.ServeHTTP(w, r)
+		})
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		baseURL := fmt.Sprintf("http://%s", listener.Addr())
+		readyStatus := func() int {
+			resp, err := http.Get(baseURL + "/readyz")
+			require.NoError(t, err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.serve(ctx, listener)
+		}()
+		assert.Equal(t, http.StatusOK, readyStatus())
+
+		slow := make(chan string, 1)
+		go func() {
+			resp, err := http.Get(baseURL + "/slow")
+			if err != nil {
+				slow <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			slow <- string(body)
+		}()
+		<-slowStarted
+
+		cancel()
+		assert.Eventually(t, srv.draining.Load, time.Second, 10*time.Millisecond)
+		assert.Equal(t, http.StatusServiceUnavailable, readyStatus(), "not ready but still serving during the delay")
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not shut down")
+		}
+		assert.Equal(t, "done", <-slow, "requests in flight are drained")
+		srv.workers.Wait()
+	})
+
+	t.Run("drainTimeout", func(t *testing.T) {
+		cfg := newTestConfig(apiURL, keyPath)
+		cfg.ShutdownDrainTimeout = 100 * time.Millisecond
+		srv, err := New(cfg)
+		require.NoError(t, err)
+		require.NoError(t, srv.Initialize())
+
+		slowStarted := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		srv.httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(slowStarted)
+			<-release
+		})
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.serve(ctx, listener)
+		}()
+
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/slow", listener.Addr()))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		<-slowStarted
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not give up draining")
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/moensch/buildkite-github-token-server/api"
+	"github.com/moensch/buildkite-github-token-server/internal/buildkite"
+	"github.com/moensch/buildkite-github-token-server/internal/contextvalues"
+)
+
+// maxWebhookSize limits how much of a webhook payload is read
+const maxWebhookSize = 1 << 20
+
+// handleBuildkiteWebhook responds to /webhooks/buildkite requests. It revokes all tokens of a job once it finished,
+// covering jobs which never call DELETE /token themselves.
+func (srv *Server) handleBuildkiteWebhook(w http.ResponseWriter, r *http.Request) {
+	logger := contextvalues.GetLogger(r.Context())
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		srv.handleError(w, r, err, "cannot read webhook", http.StatusBadRequest)
+		return
+	}
+
+	verifier := &buildkite.WebhookVerifier{
+		Token:  srv.config.WebhookToken,
+		Secret: srv.config.WebhookSecret,
+	}
+	if err := verifier.Verify(r.Header, body); err != nil {
+		srv.handleError(w, r, err, "cannot verify webhook", http.StatusUnauthorized)
+		return
+	}
+
+	event, err := buildkite.ParseWebhookEvent(body)
+	if err != nil {
+		srv.handleError(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := api.RevokeResponse{
+		RequestID: contextvalues.GetRequestID(r.Context()),
+	}
+	// Buildkite only sends the events the webhook subscribes to, anything but finished jobs is acknowledged and ignored
+	if event.Event == buildkite.WebhookEventJobFinished && event.Job.ID != "" {
+		reqLogger := logger.With(
+			zap.String("job_id", event.Job.ID),
+			zap.String("job_state", event.Job.State),
+			zap.String("pipeline_slug", event.Pipeline.Slug),
+		)
+		var known bool
+		resp.Revoked, known, err = srv.revokeJobTokens(r.Context(), reqLogger, event.Job.ID)
+		if err != nil {
+			srv.handleError(w, r, err, "cannot revoke all tokens", http.StatusInternalServerError)
+			return
+		}
+		// Buildkite delivers the webhook to any replica, only the one which minted the tokens can revoke them
+		if !known {
+			reqLogger.Warn("finished job has no registered tokens, tokens minted by another replica or before a restart are not revoked")
+		}
+		resp.Unknown = !known
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		srv.handleError(w, r, err, "cannot parse response", http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(jsonResp)
+}
@@ -0,0 +1,122 @@
+package tokenregistry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token is a minted GitHub installation token
+type Token struct {
+	Token        string
+	Host         string
+	Organization string
+	ExpiresAt    time.Time
+}
+
+// Registry remembers which tokens were minted for which Buildkite job until they expire, so they can be
+// revoked once the job finishes. It is safe for concurrent use.
+//
+// The registry only lives in memory. Tokens minted before a restart, or by another replica of the server, are
+// unknown to it and cannot be revoked through it.
+type Registry struct {
+	mu   sync.Mutex
+	jobs map[string][]Token
+
+	// taken holds when the last token of a job whose tokens were taken expires, so taking them again can be told
+	// apart from a job the registry never saw
+	taken map[string]time.Time
+
+	// now is overridable for tests
+	now func() time.Time
+}
+
+func New() *Registry {
+	return &Registry{
+		jobs:  make(map[string][]Token),
+		taken: make(map[string]time.Time),
+		now:   time.Now,
+	}
+}
+
+// Add records tokens minted for a job
+func (r *Registry) Add(jobID string, tokens ...Token) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[jobID] = append(r.jobs[jobID], tokens...)
+}
+
+// Take removes and returns all unexpired tokens of a job. known is false if the registry has no record of tokens
+// minted for the job, e.g. because they were minted by another replica or all of them expired.
+func (r *Registry) Take(jobID string) (tokens []Token, known bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, added := r.jobs[jobID]
+	lastExpiry, taken := r.taken[jobID]
+	tokens = make([]Token, 0, len(stored))
+	for _, token := range stored {
+		if token.ExpiresAt.After(r.now()) {
+			tokens = append(tokens, token)
+		}
+		if token.ExpiresAt.After(lastExpiry) {
+			lastExpiry = token.ExpiresAt
+		}
+	}
+	delete(r.jobs, jobID)
+	if lastExpiry.After(r.now()) {
+		r.taken[jobID] = lastExpiry
+	}
+	return tokens, added || taken
+}
+
+// Len returns the number of tracked tokens
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, tokens := range r.jobs {
+		count += len(tokens)
+	}
+	return count
+}
+
+// Prune forgets expired tokens, and jobs whose tokens were taken once all of them expired
+func (r *Registry) Prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for jobID, tokens := range r.jobs {
+		unexpired := tokens[:0]
+		for _, token := range tokens {
+			if token.ExpiresAt.After(r.now()) {
+				unexpired = append(unexpired, token)
+			}
+		}
+		if len(unexpired) == 0 {
+			delete(r.jobs, jobID)
+		} else {
+			r.jobs[jobID] = unexpired
+		}
+	}
+	for jobID, lastExpiry := range r.taken {
+		if !lastExpiry.After(r.now()) {
+			delete(r.taken, jobID)
+		}
+	}
+}
+
+// Run prunes expired tokens every interval until ctx is done
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Prune()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package tokenregistry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	now := time.Now()
+	r := New()
+	r.now = func() time.Time { return now }
+
+	r.Add("job1", Token{Token: "a", ExpiresAt: now.Add(time.Hour)}, Token{Token: "b", ExpiresAt: now.Add(time.Minute)})
+	r.Add("job2", Token{Token: "c", ExpiresAt: now.Add(time.Minute)})
+	assert.Equal(t, 3, r.Len())
+
+	t.Run("prune", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		r.Prune()
+		assert.Equal(t, 1, r.Len())
+	})
+
+	t.Run("take", func(t *testing.T) {
+		tokens, known := r.Take("job1")
+		assert.Equal(t, []Token{{Token: "a", ExpiresAt: now.Add(58 * time.Minute)}}, tokens)
+		assert.True(t, known)
+		assert.Equal(t, 0, r.Len())
+
+		tokens, known = r.Take("job1")
+		assert.Empty(t, tokens)
+		assert.True(t, known, "taken jobs are known until their tokens expire")
+
+		tokens, known = r.Take("job2")
+		assert.Empty(t, tokens)
+		assert.False(t, known, "job2's tokens expired and were pruned")
+	})
+
+	t.Run("takenPruned", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		r.Prune()
+		_, known := r.Take("job1")
+		assert.False(t, known)
+	})
+}
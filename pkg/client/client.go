@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os/exec"
 	"strings"
@@ -34,9 +36,63 @@ func (c *Client) GetToken(req *api.TokenRequest) (*api.TokenResponse, *api.HTTPE
 		return nil, nil, fmt.Errorf("cannot prepare request: %w", err)
 	}
 
-	request, err := http.NewRequest("POST", fmt.Sprintf("%s/token", c.ServerURL), bytes.NewBuffer(jsonBody))
+	resp := &api.TokenResponse{}
+	errResp, err := c.do(http.MethodPost, "/token", bytes.NewBuffer(jsonBody), resp)
+	if err != nil {
+		return nil, errResp, err
+	}
+	return resp, nil, nil
+}
+
+// ExplainToken returns what the server would decide for a token request, without issuing a token
+func (c *Client) ExplainToken(req *api.TokenRequest) (*api.ExplainResponse, *api.HTTPError, error) {
+	jsonBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot prepare request: %w", err)
+	}
+
+	resp := &api.ExplainResponse{}
+	errResp, err := c.do(http.MethodPost, "/token/explain", bytes.NewBuffer(jsonBody), resp)
+	if err != nil {
+		return nil, errResp, err
+	}
+	return resp, nil, nil
+}
+
+// RevokeTokens revokes all tokens issued to the current Buildkite job
+func (c *Client) RevokeTokens() (*api.RevokeResponse, *api.HTTPError, error) {
+	resp := &api.RevokeResponse{}
+	errResp, err := c.do(http.MethodDelete, "/token", nil, resp)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot create http request: %w", err)
+		return nil, errResp, err
+	}
+	return resp, nil, nil
+}
+
+// RevokeJobTokens revokes all tokens issued to the current Buildkite job and logs how many were revoked. It is
+// meant to be called from a pre-exit hook.
+func (c *Client) RevokeJobTokens(logger *log.Logger) error {
+	resp, errorResp, err := c.RevokeTokens()
+	if err != nil {
+		if errorResp != nil {
+			return fmt.Errorf("server returned error, request ID %s: %s", errorResp.RequestID, errorResp.Message)
+		}
+		return fmt.Errorf("server returned error: %w", err)
+	}
+
+	logger.Printf("server request ID: %s", resp.RequestID)
+	logger.Printf("revoked %d tokens", resp.Revoked)
+	if resp.Unknown {
+		logger.Printf("warning: the server has no record of tokens issued to this job, tokens issued by another server replica or before it restarted were not revoked")
+	}
+	return nil
+}
+
+// do sends a request authenticated with the job's Buildkite OIDC token and decodes the response into resp
+func (c *Client) do(method string, path string, body io.Reader, resp interface{}) (*api.HTTPError, error) {
+	request, err := http.NewRequest(method, fmt.Sprintf("%s%s", c.ServerURL, path), body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create http request: %w", err)
 	}
 
 	// Set auth header
@@ -44,50 +100,44 @@ func (c *Client) GetToken(req *api.TokenRequest) (*api.TokenResponse, *api.HTTPE
 	if err != nil {
 		var eErr *exec.ExitError
 		if errors.As(err, &eErr) {
-			return nil, nil, fmt.Errorf("cannot get buildkite OIDC token: %s / %w", eErr.Stderr, err)
+			return nil, fmt.Errorf("cannot get buildkite OIDC token: %s / %w", eErr.Stderr, err)
 		}
-		return nil, nil, fmt.Errorf("cannot get buildkite OIDC token: %w", err)
+		return nil, fmt.Errorf("cannot get buildkite OIDC token: %w", err)
 	}
 	request.Header.Set("X-Buildkite-OIDC-Token", fmt.Sprintf("Bearer %s", buildkiteToken))
 
 	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot get github access token: %w", err)
+		return nil, fmt.Errorf("cannot reach token server: %w", err)
 	}
 	defer response.Body.Close()
-	if err != nil {
-		return nil, nil, fmt.Errorf("http response error: %w", err)
-	}
 
 	// Read the body
-	body, err := ioutil.ReadAll(response.Body)
+	respBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot read response body: %w", err)
+		return nil, fmt.Errorf("cannot read response body: %w", err)
 	}
 
 	// Process error responses
 	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		//log.Printf("token service responded with: %s", response.Status)
 		// See if we can parse the error response
 		errResp := &api.HTTPError{}
-		err = json.Unmarshal(body, errResp)
-		if err != nil {
-			return nil, errResp, fmt.Errorf("token service responded with error")
-		} else {
-			// Just print the raw response body
-			return nil, nil, fmt.Errorf("token server responded with: %s / %s", response.Status, body)
+		err = json.Unmarshal(respBody, errResp)
+		if err == nil {
+			return errResp, fmt.Errorf("token service responded with error")
 		}
+		// Not an error response of the token server, just print the raw response body
+		return nil, fmt.Errorf("token server responded with: %s / %s", response.Status, respBody)
 	}
 
 	// Sucess
-	resp := &api.TokenResponse{}
-	err = json.Unmarshal(body, resp)
+	err = json.Unmarshal(respBody, resp)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot process server response: %w", err)
+		return nil, fmt.Errorf("cannot process server response: %w", err)
 	}
 
-	return resp, nil, nil
+	return nil, nil
 }
 
 // getBuildkiteOIDCToken invokes buildkite-agent to obtain an OIDC token
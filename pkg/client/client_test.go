@@ -1,8 +1,10 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os/exec"
@@ -52,7 +54,7 @@ func (s *testTokenServer) New(t *testing.T) *httptest.Server {
 			return
 		}
 
-		if r.URL.Path == "/token" {
+		if r.URL.Path == "/token" || r.URL.Path == "/token/explain" {
 			w.WriteHeader(s.statusCode)
 			jsonResp, _ := json.Marshal(s.response)
 			_, _ = w.Write(jsonResp)
@@ -209,3 +211,179 @@ func TestClient_GetToken(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_RevokeTokens(t *testing.T) {
+	tests := []struct {
+		name             string
+		serverResponse   interface{}
+		serverStatusCode int
+		tokenGetterFunc  func() (string, error)
+		wantRevoked      int
+		wantErr          bool
+	}{
+		{
+			name: "happypath",
+			serverResponse: api.RevokeResponse{
+				Revoked:   2,
+				RequestID: "foo",
+			},
+			serverStatusCode: http.StatusOK,
+			tokenGetterFunc:  fakeGetBuildkiteOIDCTokenOK,
+			wantRevoked:      2,
+		},
+		{
+			name: "server error",
+			serverResponse: api.HTTPError{
+				RequestID: "foo",
+				Message:   "cannot revoke all tokens",
+			},
+			serverStatusCode: http.StatusInternalServerError,
+			tokenGetterFunc:  fakeGetBuildkiteOIDCTokenOK,
+			wantErr:          true,
+		},
+		{
+			name:            "local token error",
+			tokenGetterFunc: fakeGetBuildkiteOIDCTokenFail,
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := (&testTokenServer{
+				response:   tt.serverResponse,
+				statusCode: tt.serverStatusCode,
+			}).New(t)
+			defer server.Close()
+			c := NewClient(server.URL)
+			BuildkiteTokenGetter = tt.tokenGetterFunc
+			resp, _, err := c.RevokeTokens()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RevokeTokens() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && resp.Revoked != tt.wantRevoked {
+				t.Errorf("RevokeTokens() revoked = %d, want %d", resp.Revoked, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func TestClient_RevokeJobTokens(t *testing.T) {
+	server := (&testTokenServer{
+		response:   api.RevokeResponse{Revoked: 2, RequestID: "foo"},
+		statusCode: http.StatusOK,
+	}).New(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	BuildkiteTokenGetter = fakeGetBuildkiteOIDCTokenOK
+	if err := NewClient(server.URL).RevokeJobTokens(log.New(&logs, "", 0)); err != nil {
+		t.Fatalf("RevokeJobTokens() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "revoked 2 tokens") {
+		t.Errorf("RevokeJobTokens() logged %q, want the number of revoked tokens", logs.String())
+	}
+	if strings.Contains(logs.String(), "warning") {
+		t.Errorf("RevokeJobTokens() logged %q, want no warning", logs.String())
+	}
+
+	unknownServer := (&testTokenServer{
+		response:   api.RevokeResponse{Unknown: true, RequestID: "foo"},
+		statusCode: http.StatusOK,
+	}).New(t)
+	defer unknownServer.Close()
+	logs.Reset()
+	if err := NewClient(unknownServer.URL).RevokeJobTokens(log.New(&logs, "", 0)); err != nil {
+		t.Fatalf("RevokeJobTokens() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "warning: the server has no record of tokens issued to this job") {
+		t.Errorf("RevokeJobTokens() logged %q, want a warning about the unknown job", logs.String())
+	}
+
+	BuildkiteTokenGetter = fakeGetBuildkiteOIDCTokenFail
+	if err := NewClient(server.URL).RevokeJobTokens(log.New(&logs, "", 0)); err == nil {
+		t.Errorf("RevokeJobTokens() error = nil, want an error without an OIDC token")
+	}
+}
+
+func TestClient_ErrorResponse(t *testing.T) {
+	BuildkiteTokenGetter = fakeGetBuildkiteOIDCTokenOK
+
+	t.Run("httpError", func(t *testing.T) {
+		server := (&testTokenServer{
+			response:   api.HTTPError{RequestID: "foo", Message: "not allowed to access repo"},
+			statusCode: http.StatusForbidden,
+		}).New(t)
+		defer server.Close()
+
+		_, httpErr, err := NewClient(server.URL).GetToken(&api.TokenRequest{})
+		if err == nil {
+			t.Fatal("GetToken() error = nil, want an error")
+		}
+		if httpErr == nil || httpErr.RequestID != "foo" || httpErr.Message != "not allowed to access repo" {
+			t.Errorf("GetToken() httpErr = %+v, want the server's error response", httpErr)
+		}
+	})
+
+	t.Run("otherBody", func(t *testing.T) {
+		server := (&testTokenServer{
+			response:   "bad gateway",
+			statusCode: http.StatusBadGateway,
+		}).New(t)
+		defer server.Close()
+
+		_, httpErr, err := NewClient(server.URL).GetToken(&api.TokenRequest{})
+		if httpErr != nil {
+			t.Errorf("GetToken() httpErr = %+v, want nil", httpErr)
+		}
+		if err == nil || !strings.Contains(err.Error(), "bad gateway") {
+			t.Errorf("GetToken() error = %v, want the raw response body", err)
+		}
+	})
+}
+
+func TestClient_ExplainToken(t *testing.T) {
+	request := &api.TokenRequest{
+		Repositories: []repoparser.RepositoryName{
+			{
+				Host: "github.com",
+				Org:  "myorg",
+				Repo: "service",
+			},
+		},
+		AccessLevel: api.AccessLevelRead,
+	}
+	server := (&testTokenServer{
+		response: api.ExplainResponse{
+			Allowed: false,
+			Reason:  "not allowed to access repo https://github.com/myorg/service.git: repository has no gitops.yaml",
+			Repositories: []api.RepositoryExplanation{
+				{
+					RepositoryDecision: api.RepositoryDecision{Repository: "https://github.com/myorg/service.git", Rule: "gitops"},
+					Trace: []api.TraceStep{
+						{Rule: "buildkite-plugin", Detail: "repository name does not end in -buildkite-plugin"},
+						{Rule: "pipeline-repository", Detail: "pipeline myorg/deployer builds https://github.com/myorg/deployer.git"},
+						{Rule: "gitops", Detail: "repository has no gitops.yaml"},
+					},
+				},
+			},
+			RequestID: "foo",
+		},
+		statusCode: http.StatusOK,
+	}).New(t)
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	BuildkiteTokenGetter = fakeGetBuildkiteOIDCTokenOK
+	resp, _, err := c.ExplainToken(request)
+	if err != nil {
+		t.Fatalf("ExplainToken() error = %v", err)
+	}
+	if resp.Allowed || len(resp.Repositories) != 1 || len(resp.Repositories[0].Trace) != 3 {
+		t.Errorf("ExplainToken() = %+v, want a refusal with a three step trace", resp)
+	}
+	if resp.Repositories[0].Rule != "gitops" {
+		t.Errorf("ExplainToken() rule = %s, want gitops", resp.Repositories[0].Rule)
+	}
+}